@@ -0,0 +1,782 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"example/lastfm-spotify-syncer/config"
+	"example/lastfm-spotify-syncer/sync"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/gin-gonic/gin"
+)
+
+// Add the JSON api routes, for use from scripts and home automation.
+// Everything the web UI can do is available here, but settings are set explicitly rather than toggled
+func registerApi(router *gin.RouterGroup) {
+	api := router.Group("/api/v1")
+	api.GET("/settings", apiGetSettings)
+	api.PATCH("/settings", apiUpdateSettings)
+
+	api.GET("/users", apiListUsers)
+	api.POST("/users", apiAddUser)
+	api.GET("/users/:user", apiGetUser)
+	api.PATCH("/users/:user", apiUpdateUser)
+	api.DELETE("/users/:user", apiDeleteUser)
+	api.GET("/users/:user/auth", apiGetAuthStatus)
+	api.GET("/users/:user/runs", apiListRuns)
+	api.GET("/users/:user/sync", apiGetSyncSettings)
+	api.GET("/users/:user/sync/:period", apiGetSyncPeriod)
+	api.PATCH("/users/:user/sync/:period", apiUpdateSyncPeriod)
+	api.POST("/users/:user/sync/:period/run", apiRunSync)
+
+	api.GET("/blends", apiListBlends)
+	api.POST("/blends", apiAddBlend)
+	api.GET("/blends/:blend", apiGetBlend)
+	api.PATCH("/blends/:blend", apiUpdateBlend)
+	api.DELETE("/blends/:blend", apiDeleteBlend)
+	api.POST("/blends/:blend/run", apiRunBlend)
+}
+
+// The app wide settings. Secrets are never returned, only whether they are set
+type apiSettings struct {
+	LastFMApiKey           string `json:"lastfm_api_key"`
+	LastFMSharedSecretSet  bool   `json:"lastfm_shared_secret_set"`
+	SpotifyClientId        string `json:"spotify_client_id"`
+	SpotifyClientSecretSet bool   `json:"spotify_client_secret_set"`
+	// The env vars setting any of the above or the server settings, which can't be changed through the api
+	Locked   []string      `json:"locked"`
+	Server   config.Server `json:"server"`
+	Problems []string      `json:"problems"`
+}
+
+// A user, without their lastfm and spotify tokens
+type apiUser struct {
+	Id                string              `json:"id"`
+	Name              string              `json:"name"`
+	LastFMUsername    string              `json:"lastfm_username"`
+	LastFMAuthorized  bool                `json:"lastfm_authorized"`
+	SpotifyAuthorized bool                `json:"spotify_authorized"`
+	ReauthRequired    bool                `json:"reauth_required"`
+	Sync              config.SyncSettings `json:"sync"`
+	Problems          []string            `json:"problems"`
+}
+
+func newApiUser(conf *config.Config, user *config.User) apiUser {
+	problems := []string{}
+	for _, problem := range conf.Validate() {
+		if problem.UserId == user.Id {
+			problems = append(problems, problem.Message)
+		}
+	}
+
+	return apiUser{
+		Id:                user.Id,
+		Name:              user.Name,
+		LastFMUsername:    user.LastFM.Username,
+		LastFMAuthorized:  user.LastFM.Token != "",
+		SpotifyAuthorized: user.Spotify.RefreshToken != "",
+		ReauthRequired:    user.LastFM.ReauthRequired || user.Spotify.ReauthRequired,
+		Sync:              user.Sync,
+		Problems:          problems,
+	}
+}
+
+// Returned when a change would introduce problems with the config
+type problemsError struct {
+	problems []string
+}
+
+func (e *problemsError) Error() string {
+	return strings.Join(e.problems, "; ")
+}
+
+// Find the config problems in after that aren't in before
+func newProblems(before []config.ValidationError, after []config.ValidationError) error {
+	existing := make(map[string]bool)
+	for _, problem := range before {
+		existing[problem.Message] = true
+	}
+	var problems []string
+	for _, problem := range after {
+		if !existing[problem.Message] {
+			problems = append(problems, problem.Message)
+		}
+	}
+	if len(problems) > 0 {
+		return &problemsError{problems}
+	}
+
+	return nil
+}
+
+func apiError(c *gin.Context, status int, message string) {
+	c.JSON(status, gin.H{"error": message})
+}
+
+// Respond to a failed api request with a status matching the error
+func apiRespondError(c *gin.Context, err error) {
+	var inputErr *invalidInputError
+	var problemsErr *problemsError
+	switch {
+	case errors.Is(err, errNotFound):
+		apiError(c, http.StatusNotFound, "Not found")
+	case errors.Is(err, errLastUser):
+		apiError(c, http.StatusBadRequest, "The last user cannot be removed")
+	case errors.As(err, &inputErr):
+		apiError(c, http.StatusBadRequest, inputErr.Error())
+	case errors.As(err, &problemsErr):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The change would cause problems with the config", "problems": problemsErr.problems})
+	default:
+		log.Error("Api request failed", "error", err)
+		apiError(c, http.StatusInternalServerError, "Something went wrong, check the logs for details")
+	}
+}
+
+// Decode a JSON body into value, only setting the fields given. Unknown fields are an error, so typos aren't ignored
+func decodeJson(body []byte, value any) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(value)
+	if err != nil {
+		return &invalidInputError{"Invalid JSON given: " + err.Error()}
+	}
+
+	return nil
+}
+
+// Read and decode the request body, responding with an error if it isn't valid
+func bindJson(c *gin.Context, value any) bool {
+	body, err := io.ReadAll(c.Request.Body)
+	if err == nil {
+		err = decodeJson(body, value)
+	}
+	if err != nil {
+		apiRespondError(c, err)
+		return false
+	}
+
+	return true
+}
+
+// Load the config, responding with an error if it can't be
+func apiLoadConfig(c *gin.Context) (*config.Config, bool) {
+	conf, err := config.LoadConfig(false)
+	if err != nil {
+		apiRespondError(c, err)
+		return nil, false
+	}
+
+	return conf, true
+}
+
+// Load the config and the user given in the url, responding with an error if either can't be found
+func apiLoadUser(c *gin.Context) (*config.Config, *config.User, bool) {
+	conf, ok := apiLoadConfig(c)
+	if !ok {
+		return nil, nil, false
+	}
+	user := conf.GetUser(c.Param("user"))
+	if user == nil {
+		apiRespondError(c, errNotFound)
+		return nil, nil, false
+	}
+
+	return conf, user, true
+}
+
+func apiGetSettings(c *gin.Context) {
+	conf, ok := apiLoadConfig(c)
+	if !ok {
+		return
+	}
+	server, err := config.GetServer()
+	if err != nil {
+		apiRespondError(c, err)
+		return
+	}
+
+	settings := apiSettings{
+		LastFMApiKey:           conf.Auth.LastFM.ApiKey,
+		LastFMSharedSecretSet:  conf.Auth.LastFM.SharedSecret != "",
+		SpotifyClientId:        conf.Auth.Spotify.ClientId,
+		SpotifyClientSecretSet: conf.Auth.Spotify.ClientSecret != "",
+		Locked:                 []string{},
+		Server:                 *server,
+		Problems:               []string{},
+	}
+	fields := []string{"lastfm-api-key", "lastfm-shared-secret", "spotify-client-id", "spotify-client-secret",
+		"base-url", "listen-address", "port", "tls-cert-file", "tls-key-file"}
+	for _, field := range fields {
+		if env := config.EnvOverride(field); env != "" {
+			settings.Locked = append(settings.Locked, env)
+		}
+	}
+	for _, problem := range conf.Validate() {
+		if problem.UserId == "" {
+			settings.Problems = append(settings.Problems, problem.Message)
+		}
+	}
+
+	c.JSON(http.StatusOK, settings)
+}
+
+// Update the lastfm and spotify app credentials. Only the fields given are changed
+func apiUpdateSettings(c *gin.Context) {
+	var params struct {
+		LastFMApiKey        *string `json:"lastfm_api_key"`
+		LastFMSharedSecret  *string `json:"lastfm_shared_secret"`
+		SpotifyClientId     *string `json:"spotify_client_id"`
+		SpotifyClientSecret *string `json:"spotify_client_secret"`
+	}
+	if !bindJson(c, &params) {
+		return
+	}
+
+	fields := []struct {
+		id    string
+		value *string
+		set   func(conf *config.Config, value string)
+	}{
+		{"lastfm-api-key", params.LastFMApiKey, func(conf *config.Config, v string) { conf.Auth.LastFM.ApiKey = v }},
+		{"lastfm-shared-secret", params.LastFMSharedSecret, func(conf *config.Config, v string) { conf.Auth.LastFM.SharedSecret = v }},
+		{"spotify-client-id", params.SpotifyClientId, func(conf *config.Config, v string) { conf.Auth.Spotify.ClientId = v }},
+		{"spotify-client-secret", params.SpotifyClientSecret, func(conf *config.Config, v string) { conf.Auth.Spotify.ClientSecret = v }},
+	}
+	for _, field := range fields {
+		if env := config.EnvOverride(field.id); field.value != nil && env != "" {
+			apiError(c, http.StatusConflict, "This setting is set by the "+env+" env var and can't be changed")
+			return
+		}
+	}
+
+	err := config.Update(func(conf *config.Config) error {
+		for _, field := range fields {
+			if field.value != nil {
+				field.set(conf, strings.TrimSpace(*field.value))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		apiRespondError(c, err)
+		return
+	}
+
+	apiGetSettings(c)
+}
+
+func apiListUsers(c *gin.Context) {
+	conf, ok := apiLoadConfig(c)
+	if !ok {
+		return
+	}
+
+	users := []apiUser{}
+	for i := range conf.Users {
+		users = append(users, newApiUser(conf, &conf.Users[i]))
+	}
+	c.JSON(http.StatusOK, users)
+}
+
+func apiAddUser(c *gin.Context) {
+	var params struct {
+		Name           string `json:"name"`
+		LastFMUsername string `json:"lastfm_username"`
+	}
+	if !bindJson(c, &params) {
+		return
+	}
+	name := strings.TrimSpace(params.Name)
+	if name == "" {
+		apiError(c, http.StatusBadRequest, "A name is required")
+		return
+	}
+
+	var user config.User
+	err := config.Update(func(conf *config.Config) error {
+		added := conf.AddUser(name)
+		added.LastFM.Username = strings.TrimSpace(params.LastFMUsername)
+		user = *added
+		return nil
+	})
+	if err != nil {
+		apiRespondError(c, err)
+		return
+	}
+	log.Info("Added user", "id", user.Id, "name", user.Name)
+
+	conf, ok := apiLoadConfig(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusCreated, newApiUser(conf, &user))
+}
+
+func apiGetUser(c *gin.Context) {
+	conf, user, ok := apiLoadUser(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, newApiUser(conf, user))
+}
+
+// Update a user's name or lastfm username. Only the fields given are changed
+func apiUpdateUser(c *gin.Context) {
+	var params struct {
+		Name           *string `json:"name"`
+		LastFMUsername *string `json:"lastfm_username"`
+	}
+	if !bindJson(c, &params) {
+		return
+	}
+
+	err := config.Update(func(conf *config.Config) error {
+		user := conf.GetUser(c.Param("user"))
+		if user == nil {
+			return errNotFound
+		}
+		if params.Name != nil {
+			name := strings.TrimSpace(*params.Name)
+			if name == "" {
+				return &invalidInputError{"A name is required"}
+			}
+			user.Name = name
+		}
+		if params.LastFMUsername != nil {
+			user.LastFM.Username = strings.TrimSpace(*params.LastFMUsername)
+		}
+		return nil
+	})
+	if err != nil {
+		apiRespondError(c, err)
+		return
+	}
+
+	apiGetUser(c)
+}
+
+func apiDeleteUser(c *gin.Context) {
+	err := removeUser(c.Param("user"))
+	if err != nil {
+		apiRespondError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// Check whether the user's lastfm and spotify credentials still work
+func apiGetAuthStatus(c *gin.Context) {
+	_, user, ok := apiLoadUser(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, []authStatus{
+		getLastFmAuthStatus(user),
+		getSpotifyAuthStatus(user),
+	})
+}
+
+// List the user's sync runs, newest first.
+// They can be filtered to a single sync with ?period=, and limited with ?limit=
+func apiListRuns(c *gin.Context) {
+	_, user, ok := apiLoadUser(c)
+	if !ok {
+		return
+	}
+	period := c.Query("period")
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(config.MAX_HISTORY)))
+	if err != nil || limit < 0 {
+		apiError(c, http.StatusBadRequest, "Invalid limit given")
+		return
+	}
+
+	runs := []config.SyncRun{}
+	for i := len(user.History) - 1; i >= 0 && len(runs) < limit; i-- {
+		if period == "" || user.History[i].Period == period {
+			runs = append(runs, user.History[i])
+		}
+	}
+	c.JSON(http.StatusOK, runs)
+}
+
+func apiGetSyncSettings(c *gin.Context) {
+	_, user, ok := apiLoadUser(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, user.Sync)
+}
+
+func apiGetSyncPeriod(c *gin.Context) {
+	_, user, ok := apiLoadUser(c)
+	if !ok {
+		return
+	}
+	settings := user.Sync.ForPeriod(c.Param("period"))
+	if settings == nil {
+		apiRespondError(c, errNotFound)
+		return
+	}
+
+	c.JSON(http.StatusOK, settings)
+}
+
+// Update the settings for one of a user's syncs, e.g. {"enabled": true, "max_tracks": 30}.
+// Only the fields given are changed, and the sync's job is started or stopped to match
+func apiUpdateSyncPeriod(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		apiRespondError(c, err)
+		return
+	}
+	userId := c.Param("user")
+	period := c.Param("period")
+
+	err = config.Update(func(conf *config.Config) error {
+		user := conf.GetUser(userId)
+		if user == nil {
+			return errNotFound
+		}
+		target := user.Sync.ForPeriod(period)
+		if target == nil {
+			return errNotFound
+		}
+
+		before := conf.Validate()
+		err := applySyncUpdate(body, target)
+		if err != nil {
+			return err
+		}
+		return newProblems(before, conf.Validate())
+	})
+	if err != nil {
+		apiRespondError(c, err)
+		return
+	}
+	reconcileJobs()
+
+	apiGetSyncPeriod(c)
+}
+
+// The settings of each sync that can be changed through the api. Fields that aren't given are left as they are.
+// The playlists a sync maintains and when it last ran are kept track of by the app, so can't be set
+type apiPeriodUpdate struct {
+	Enabled         *bool     `json:"enabled"`
+	MaxTracks       *int      `json:"max_tracks"`
+	Source          *string   `json:"source"`
+	ArtistCount     *int      `json:"artist_count"`
+	TracksPerArtist *int      `json:"tracks_per_artist"`
+	ArtistTracks    *string   `json:"artist_tracks"`
+	IncludeTags     *[]string `json:"include_tags"`
+	ExcludeTags     *[]string `json:"exclude_tags"`
+	MinTagWeight    *int      `json:"min_tag_weight"`
+	CustomCover     *bool     `json:"custom_cover"`
+}
+
+type apiLovedUpdate struct {
+	Enabled       *bool `json:"enabled"`
+	MaxTracks     *int  `json:"max_tracks"`
+	RemoveUnloved *bool `json:"remove_unloved"`
+}
+
+type apiDiscoveryUpdate struct {
+	Enabled       *bool    `json:"enabled"`
+	MaxTracks     *int     `json:"max_tracks"`
+	SeedPeriod    *string  `json:"seed_period"`
+	SeedCount     *int     `json:"seed_count"`
+	MinSimilarity *float64 `json:"min_similarity"`
+}
+
+type apiRediscoveryUpdate struct {
+	Enabled      *bool `json:"enabled"`
+	MaxTracks    *int  `json:"max_tracks"`
+	Months       *int  `json:"months"`
+	MinPlaycount *int  `json:"min_playcount"`
+}
+
+type apiLikedUpdate struct {
+	Enabled *bool   `json:"enabled"`
+	Source  *string `json:"source"`
+	// The playlist to take tracks from, with the playlist source
+	PlaylistId *string `json:"playlist_id"`
+}
+
+type apiRecentUpdate struct {
+	Enabled *bool `json:"enabled"`
+}
+
+func (u *apiPeriodUpdate) apply(settings *config.Period) {
+	setIfGiven(&settings.Enabled, u.Enabled)
+	setIfGiven(&settings.MaxTracks, u.MaxTracks)
+	setIfGiven(&settings.Source, u.Source)
+	setIfGiven(&settings.ArtistCount, u.ArtistCount)
+	setIfGiven(&settings.TracksPerArtist, u.TracksPerArtist)
+	setIfGiven(&settings.ArtistTracks, u.ArtistTracks)
+	setIfGiven(&settings.IncludeTags, u.IncludeTags)
+	setIfGiven(&settings.ExcludeTags, u.ExcludeTags)
+	setIfGiven(&settings.MinTagWeight, u.MinTagWeight)
+	setIfGiven(&settings.CustomCover, u.CustomCover)
+}
+
+func (u *apiLovedUpdate) apply(settings *config.LovedSync) {
+	setIfGiven(&settings.Enabled, u.Enabled)
+	setIfGiven(&settings.MaxTracks, u.MaxTracks)
+	setIfGiven(&settings.RemoveUnloved, u.RemoveUnloved)
+}
+
+func (u *apiDiscoveryUpdate) apply(settings *config.DiscoverySync) {
+	setIfGiven(&settings.Enabled, u.Enabled)
+	setIfGiven(&settings.MaxTracks, u.MaxTracks)
+	setIfGiven(&settings.SeedPeriod, u.SeedPeriod)
+	setIfGiven(&settings.SeedCount, u.SeedCount)
+	setIfGiven(&settings.MinSimilarity, u.MinSimilarity)
+}
+
+func (u *apiRediscoveryUpdate) apply(settings *config.RediscoverySync) {
+	setIfGiven(&settings.Enabled, u.Enabled)
+	setIfGiven(&settings.MaxTracks, u.MaxTracks)
+	setIfGiven(&settings.Months, u.Months)
+	setIfGiven(&settings.MinPlaycount, u.MinPlaycount)
+}
+
+func (u *apiLikedUpdate) apply(settings *config.LikedSync) {
+	setIfGiven(&settings.Enabled, u.Enabled)
+	setIfGiven(&settings.Source, u.Source)
+	if u.PlaylistId != nil {
+		settings.PlaylistId = strings.TrimSpace(*u.PlaylistId)
+	}
+}
+
+func (u *apiRecentUpdate) apply(settings *config.RecentlyPlayedSync) {
+	setIfGiven(&settings.Enabled, u.Enabled)
+}
+
+func setIfGiven[T any](field *T, value *T) {
+	if value != nil {
+		*field = *value
+	}
+}
+
+// Decode an update to a sync's settings from a JSON body, and apply it to the settings.
+// The settings are as returned from SyncSettings.ForPeriod
+func applySyncUpdate(body []byte, settings any) error {
+	switch settings := settings.(type) {
+	case *config.Period:
+		return decodeUpdate(body, settings, (*apiPeriodUpdate).apply)
+	case *config.LovedSync:
+		return decodeUpdate(body, settings, (*apiLovedUpdate).apply)
+	case *config.DiscoverySync:
+		return decodeUpdate(body, settings, (*apiDiscoveryUpdate).apply)
+	case *config.RediscoverySync:
+		return decodeUpdate(body, settings, (*apiRediscoveryUpdate).apply)
+	case *config.LikedSync:
+		return decodeUpdate(body, settings, (*apiLikedUpdate).apply)
+	case *config.RecentlyPlayedSync:
+		return decodeUpdate(body, settings, (*apiRecentUpdate).apply)
+	}
+
+	return errNotFound
+}
+
+func decodeUpdate[S any, U any](body []byte, settings S, apply func(update *U, settings S)) error {
+	var update U
+	err := decodeJson(body, &update)
+	if err != nil {
+		return err
+	}
+	apply(&update, settings)
+
+	return nil
+}
+
+// Run one of a user's syncs now, returning the record of the run
+func apiRunSync(c *gin.Context) {
+	_, user, ok := apiLoadUser(c)
+	if !ok {
+		return
+	}
+	period := c.Param("period")
+	if user.Sync.ForPeriod(period) == nil {
+		apiRespondError(c, errNotFound)
+		return
+	}
+
+	err := sync.Sync(user.Id, period)
+	apiRespondRun(c, user.Id, period, err)
+}
+
+// Respond with the latest run of a sync, with a status matching how it went
+func apiRespondRun(c *gin.Context, userId string, period string, err error) {
+	status := http.StatusOK
+	if err != nil {
+		log.Error("Error running sync", "error", err)
+		status = http.StatusInternalServerError
+		if sync.FlagReauthRequired(userId, err) {
+			status = http.StatusUnauthorized
+		}
+	}
+
+	conf, ok := apiLoadConfig(c)
+	if !ok {
+		return
+	}
+	user := conf.GetUser(userId)
+	if user != nil {
+		for i := len(user.History) - 1; i >= 0; i-- {
+			if user.History[i].Period == period {
+				c.JSON(status, user.History[i])
+				return
+			}
+		}
+	}
+	// The run couldn't be recorded, e.g. because the config couldn't be loaded to start the sync
+	if err != nil {
+		apiError(c, status, "The sync failed, check the logs for details")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func apiListBlends(c *gin.Context) {
+	conf, ok := apiLoadConfig(c)
+	if !ok {
+		return
+	}
+
+	blends := conf.Blends
+	if blends == nil {
+		blends = []config.Blend{}
+	}
+	c.JSON(http.StatusOK, blends)
+}
+
+// Add a blend, which is enabled straight away
+func apiAddBlend(c *gin.Context) {
+	var params struct {
+		Name      string             `json:"name"`
+		OwnerId   string             `json:"owner_id"`
+		Usernames []string           `json:"usernames"`
+		Weights   map[string]float64 `json:"weights"`
+		Period    string             `json:"period"`
+		Strategy  string             `json:"strategy"`
+		MaxTracks int                `json:"max_tracks"`
+	}
+	if !bindJson(c, &params) {
+		return
+	}
+
+	blend, err := createBlend(config.Blend{
+		Name:      strings.TrimSpace(params.Name),
+		OwnerId:   params.OwnerId,
+		Usernames: params.Usernames,
+		Weights:   params.Weights,
+		Period:    params.Period,
+		Strategy:  params.Strategy,
+		MaxTracks: params.MaxTracks,
+	})
+	if errors.Is(err, errNotFound) {
+		apiError(c, http.StatusBadRequest, "No user with the given owner id")
+		return
+	}
+	if err != nil {
+		apiRespondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, blend)
+}
+
+func apiGetBlend(c *gin.Context) {
+	conf, ok := apiLoadConfig(c)
+	if !ok {
+		return
+	}
+	blend := conf.GetBlend(c.Param("blend"))
+	if blend == nil {
+		apiRespondError(c, errNotFound)
+		return
+	}
+
+	c.JSON(http.StatusOK, blend)
+}
+
+// The settings of a blend that can be changed through the api. Fields that aren't given are left as they are,
+// and weights replace the existing ones. The owner can't be changed, as the playlist belongs to their spotify account
+type apiBlendUpdate struct {
+	Name      *string             `json:"name"`
+	Enabled   *bool               `json:"enabled"`
+	Usernames *[]string           `json:"usernames"`
+	Weights   *map[string]float64 `json:"weights"`
+	Period    *string             `json:"period"`
+	Strategy  *string             `json:"strategy"`
+	MaxTracks *int                `json:"max_tracks"`
+}
+
+func (u *apiBlendUpdate) apply(blend *config.Blend) {
+	if u.Name != nil {
+		blend.Name = strings.TrimSpace(*u.Name)
+	}
+	setIfGiven(&blend.Enabled, u.Enabled)
+	setIfGiven(&blend.Usernames, u.Usernames)
+	setIfGiven(&blend.Weights, u.Weights)
+	setIfGiven(&blend.Period, u.Period)
+	setIfGiven(&blend.Strategy, u.Strategy)
+	setIfGiven(&blend.MaxTracks, u.MaxTracks)
+	if blend.Name == "" {
+		blend.Name = strings.Join(blend.Usernames, " + ")
+	}
+}
+
+// Update a blend's settings, e.g. {"enabled": false}. Only the fields given are changed
+func apiUpdateBlend(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		apiRespondError(c, err)
+		return
+	}
+
+	blend, err := updateBlend(c.Param("blend"), func(blend *config.Blend) error {
+		return decodeUpdate(body, blend, (*apiBlendUpdate).apply)
+	})
+	if err != nil {
+		apiRespondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, blend)
+}
+
+func apiDeleteBlend(c *gin.Context) {
+	err := removeBlend(c.Param("blend"))
+	if err != nil {
+		apiRespondError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// Run a blend's sync now, returning the record of the run
+func apiRunBlend(c *gin.Context) {
+	conf, ok := apiLoadConfig(c)
+	if !ok {
+		return
+	}
+	blend := conf.GetBlend(c.Param("blend"))
+	if blend == nil {
+		apiRespondError(c, errNotFound)
+		return
+	}
+
+	err := sync.SyncBlend(blend.Id)
+	apiRespondRun(c, blend.OwnerId, "blend", err)
+}
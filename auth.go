@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"example/lastfm-spotify-syncer/config"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gin-gonic/gin"
+)
+
+// The cookie holding the signed in admin session
+const SESSION_COOKIE = "syncer_session"
+
+// How long a session lasts before the password is needed again
+const SESSION_TTL = 30 * 24 * time.Hour
+
+// The cookie holding the token forms must send back to show they came from the app's own pages.
+// It is given in the csrf-token form field, or the X-CSRF-Token header for htmx requests
+const (
+	CSRF_COOKIE = "syncer_csrf"
+	CSRF_FIELD  = "csrf-token"
+	CSRF_HEADER = "X-CSRF-Token"
+)
+
+// How a request was signed in
+const (
+	AUTH_NONE    = ""
+	AUTH_SESSION = "session"
+	AUTH_PROXY   = "proxy"
+	AUTH_TOKEN   = "token"
+)
+
+// Keys for values stored on the request context
+const (
+	authMethodKey = "authMethod"
+	csrfTokenKey  = "csrfToken"
+)
+
+// Middleware to require signing in, when a password or proxy auth header is set, and to check state changing
+// requests came from the app's own pages.
+// Forms need the csrf token. Api requests either need a token, or to be sent as JSON, which browsers won't do
+// cross site without permission
+func requireAuth(c *gin.Context) {
+	conf, err := config.LoadConfig(false)
+	if err != nil {
+		log.Error("Error reading config", "error", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	security := &conf.Config.Security
+	// Prometheus is treated like the api, so it gets a 401 rather than the login page
+	isApi := strings.HasPrefix(c.Request.URL.Path, "/api/") || c.Request.URL.Path == "/metrics"
+
+	method, name := authenticate(c, security)
+	if method == AUTH_NONE && security.AuthEnabled() {
+		if isApi {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Sign in required"})
+			return
+		}
+		if c.GetHeader("HX-Request") != "" {
+			// Have htmx load the login page, rather than swapping it into part of the current page
+			c.Header("HX-Redirect", "/login")
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		if c.Request.Method == http.MethodGet {
+			c.Redirect(http.StatusFound, "/login?next="+url.QueryEscape(c.Request.URL.RequestURI()))
+			c.Abort()
+			return
+		}
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	c.Set(authMethodKey, method)
+
+	if !isSafeMethod(c.Request.Method) && method != AUTH_TOKEN {
+		if isApi && c.ContentType() != gin.MIMEJSON {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Requests must be sent as application/json, or use an api token"})
+			return
+		}
+		if !isApi && !checkCsrf(c) {
+			log.Warn("Invalid csrf token", "path", c.Request.URL.Path, "ip", c.ClientIP())
+			c.String(http.StatusForbidden, "The form has expired, go back and refresh the page to try again")
+			c.Abort()
+			return
+		}
+	}
+	if name != "" {
+		log.Debug("Signed in", "method", method, "name", name)
+	}
+
+	c.Next()
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// Work out how the request is signed in, returning the method and who signed in, if anyone
+func authenticate(c *gin.Context, security *config.Security) (string, string) {
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		if apiToken := security.CheckApiToken(token); apiToken != nil {
+			return AUTH_TOKEN, apiToken.Name
+		}
+		log.Warn("Invalid api token given", "ip", c.ClientIP())
+		return AUTH_NONE, ""
+	}
+
+	if security.ProxyAuthHeader != "" {
+		if name := c.GetHeader(security.ProxyAuthHeader); name != "" {
+			if security.IsTrustedProxy(c.RemoteIP()) {
+				return AUTH_PROXY, name
+			}
+			log.Warn("Ignoring proxy auth header from an untrusted address", "ip", c.RemoteIP())
+		}
+	}
+
+	if security.PasswordHash != "" {
+		cookie, err := c.Cookie(SESSION_COOKIE)
+		if err == nil {
+			value, err := verifyCookieValue(cookie)
+			if err == nil && subtle.ConstantTimeCompare([]byte(value), []byte(sessionFingerprint(security))) == 1 {
+				return AUTH_SESSION, "admin"
+			}
+		}
+	}
+
+	return AUTH_NONE, ""
+}
+
+// Sessions are tied to the password and session generation they were signed in with,
+// so changing the password or signing out signs everyone out
+func sessionFingerprint(security *config.Security) string {
+	hash := sha256.Sum256([]byte("session:" + strconv.Itoa(security.SessionGeneration) + ":" + security.PasswordHash))
+	return hex.EncodeToString(hash[:16])
+}
+
+// Whether cookies should only be sent over https
+func secureCookies() bool {
+	server, err := config.GetServer()
+	return err == nil && server.IsSecure()
+}
+
+// Get the csrf token for forms on the page, setting the cookie it is checked against if there isn't one yet
+func csrfToken(c *gin.Context) string {
+	if token := c.GetString(csrfTokenKey); token != "" {
+		return token
+	}
+
+	token, err := c.Cookie(CSRF_COOKIE)
+	if err != nil || len(token) != 32 {
+		token = randomString(32)
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(CSRF_COOKIE, token, 60*60*24*365, "/", "", secureCookies(), true)
+	}
+	c.Set(csrfTokenKey, token)
+
+	return token
+}
+
+// Check the request includes the csrf token from its cookie
+func checkCsrf(c *gin.Context) bool {
+	cookie, err := c.Cookie(CSRF_COOKIE)
+	if err != nil || cookie == "" {
+		return false
+	}
+	token := c.GetHeader(CSRF_HEADER)
+	if token == "" {
+		token = c.PostForm(CSRF_FIELD)
+	}
+
+	return subtle.ConstantTimeCompare([]byte(cookie), []byte(token)) == 1
+}
+
+// Only redirect to pages on this site after signing in
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// Show the sign in page
+func getLogin(c *gin.Context) {
+	conf, err := config.LoadConfig(false)
+	if err != nil {
+		log.Error("Error reading config", "error", err)
+		c.String(http.StatusInternalServerError, "Error reading config file")
+		return
+	}
+	if conf.Config.Security.PasswordHash == "" {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	c.HTML(http.StatusOK, "login", gin.H{
+		"csrfToken": csrfToken(c),
+		"next":      safeRedirect(c.Query("next")),
+	})
+}
+
+// Check the admin password and start a session
+func postLogin(c *gin.Context) {
+	conf, err := config.LoadConfig(false)
+	if err != nil {
+		log.Error("Error reading config", "error", err)
+		c.String(http.StatusInternalServerError, "Error reading config file")
+		return
+	}
+	security := &conf.Config.Security
+	next := safeRedirect(c.PostForm("next"))
+	if !checkCsrf(c) {
+		c.String(http.StatusForbidden, "The form has expired, go back and refresh the page to try again")
+		return
+	}
+
+	if !security.CheckPassword(c.PostForm("password")) {
+		log.Warn("Failed sign in", "ip", c.ClientIP())
+		c.HTML(http.StatusUnauthorized, "login", gin.H{
+			"csrfToken": csrfToken(c),
+			"next":      next,
+			"error":     "Incorrect password",
+		})
+		return
+	}
+
+	log.Info("Signed in", "ip", c.ClientIP())
+	value, err := signCookieValue(sessionFingerprint(security), time.Now().Add(SESSION_TTL))
+	if err != nil {
+		log.Error("Error signing session cookie", "error", err)
+		c.String(http.StatusInternalServerError, "Error signing in")
+		return
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(SESSION_COOKIE, value, int(SESSION_TTL.Seconds()), "/", "", secureCookies(), true)
+	c.Redirect(http.StatusFound, next)
+}
+
+// End the current session. The cookie alone can't be trusted to go away, so every session is ended
+func postLogout(c *gin.Context) {
+	err := config.Update(func(conf *config.Config) error {
+		conf.Config.Security.EndSessions()
+		return nil
+	})
+	if err != nil {
+		respondUpdateError(c, err, "")
+		return
+	}
+
+	log.Info("Signed out", "ip", c.ClientIP())
+	c.SetCookie(SESSION_COOKIE, "", -1, "/", "", secureCookies(), true)
+	c.Redirect(http.StatusFound, "/login")
+}
+
+// Create an api token, showing it once
+func addApiToken(c *gin.Context) {
+	name := strings.TrimSpace(c.PostForm("name"))
+	if name == "" {
+		c.String(http.StatusBadRequest, "A name is required")
+		return
+	}
+
+	var token string
+	err := config.Update(func(conf *config.Config) error {
+		var err error
+		token, err = conf.Config.Security.AddApiToken(name)
+		return err
+	})
+	if err != nil {
+		respondUpdateError(c, err, "")
+		return
+	}
+	log.Info("Added api token", "name", name)
+
+	c.HTML(http.StatusOK, "token-created", gin.H{
+		"name":  name,
+		"token": token,
+	})
+}
+
+// Revoke an api token
+func deleteApiToken(c *gin.Context) {
+	err := config.Update(func(conf *config.Config) error {
+		if !conf.Config.Security.RemoveApiToken(c.Param("token")) {
+			return errNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		respondUpdateError(c, err, "No such token")
+		return
+	}
+	log.Info("Removed api token", "id", c.Param("token"))
+
+	c.Redirect(http.StatusFound, "/")
+}
+
+// Set the admin password from stdin, for the --set-password flag
+func setPasswordFromStdin() error {
+	if env := config.EnvOverride("admin-password-hash"); env != "" {
+		return fmt.Errorf("the password is set by the %s env var", env)
+	}
+
+	fmt.Fprint(os.Stderr, "New admin password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return err
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return errors.New("the password can't be empty")
+	}
+
+	return config.Update(func(conf *config.Config) error {
+		return conf.Config.Security.SetPassword(password)
+	})
+}
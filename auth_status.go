@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"example/lastfm-spotify-syncer/config"
+	lastFmApi "example/lastfm-spotify-syncer/lastfm/api"
+	spotifyApi "example/lastfm-spotify-syncer/spotify/api"
+	"fmt"
+
+	"github.com/charmbracelet/log"
+)
+
+// The state of the credentials for a service, as shown on the index page
+type authStatus struct {
+	Service        string `json:"service"`
+	Ok             bool   `json:"ok"`
+	ReauthRequired bool   `json:"reauth_required"`
+	Message        string `json:"message"`
+}
+
+// Check the user's stored credentials for lastfm still work
+func getLastFmAuthStatus(user *config.User) authStatus {
+	status := authStatus{Service: "LastFM"}
+	if user.LastFM.Token == "" || user.LastFM.Username == "" {
+		status.Message = "Not signed in"
+		return status
+	}
+	// The session key can only be checked by signed requests, so rely on the flag set by failed syncs
+	if user.LastFM.ReauthRequired {
+		status.ReauthRequired = true
+		status.Message = "Re-authorization required"
+		return status
+	}
+
+	userInfo, err := lastFmApi.CheckAuth(user.LastFM.Username)
+	var apiErr *lastFmApi.Error
+	switch {
+	case lastFmApi.IsReauthRequired(err):
+		status.ReauthRequired = true
+		status.Message = "Re-authorization required: " + err.Error()
+	case errors.As(err, &apiErr):
+		status.Message = apiErr.Message
+	case err != nil:
+		log.Error("Error checking lastfm auth", "error", err)
+		status.Message = "Unable to reach LastFM"
+	default:
+		status.Ok = true
+		status.Message = fmt.Sprintf("Signed in as %s", userInfo.User.Name)
+	}
+
+	return status
+}
+
+// Check the user's stored tokens for spotify still work
+func getSpotifyAuthStatus(user *config.User) authStatus {
+	status := authStatus{Service: "Spotify"}
+	if user.Spotify.RefreshToken == "" {
+		status.Message = "Not signed in"
+		return status
+	}
+
+	userData, err := spotifyApi.CheckAuth(user.Id)
+	switch {
+	case errors.Is(err, spotifyApi.ErrReauthRequired):
+		status.ReauthRequired = true
+		status.Message = "Re-authorization required"
+	case err != nil:
+		log.Error("Error checking spotify auth", "error", err)
+		status.Message = "Unable to reach Spotify"
+		if user.Spotify.ReauthRequired {
+			status.ReauthRequired = true
+			status.Message = "Re-authorization required"
+		}
+	default:
+		status.Ok = true
+		status.Message = fmt.Sprintf("Signed in as %s", userData.DisplayName)
+		// The tokens work again, so there's nothing to re-authorize and the user's jobs can run again
+		if user.Spotify.ReauthRequired {
+			user.Spotify.ReauthRequired = false
+			config.Update(func(conf *config.Config) error {
+				if u := conf.GetUser(user.Id); u != nil {
+					u.Spotify.ReauthRequired = false
+				}
+				return nil
+			})
+		}
+	}
+
+	return status
+}
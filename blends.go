@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"example/lastfm-spotify-syncer/config"
+	"example/lastfm-spotify-syncer/scheduler"
+	"example/lastfm-spotify-syncer/sync"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/gin-gonic/gin"
+)
+
+// Add a blend owned by the current user
+func addBlend(c *gin.Context) {
+	type AddBlendParams struct {
+		Name      string `form:"name"`
+		Usernames string `form:"usernames"`
+		Period    string `form:"period"`
+		Strategy  string `form:"strategy"`
+		MaxTracks int    `form:"max-tracks"`
+	}
+	var params AddBlendParams
+	if err := c.ShouldBind(&params); err != nil {
+		log.Error("error reading input", "error", err)
+		c.String(http.StatusBadRequest, "Error reading blend parameters")
+		return
+	}
+
+	usernames, weights, err := parseBlendUsers(params.Usernames)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	conf, err := config.LoadConfig(false)
+	if err != nil {
+		log.Error("Error reading config", "error", err)
+		c.String(http.StatusInternalServerError, "Error reading config file")
+		return
+	}
+	user := getCurrentUser(c, conf)
+	_, err = createBlend(config.Blend{
+		Name:      strings.TrimSpace(params.Name),
+		OwnerId:   user.Id,
+		Usernames: usernames,
+		Weights:   weights,
+		Period:    params.Period,
+		Strategy:  params.Strategy,
+		MaxTracks: params.MaxTracks,
+	})
+	var invalidErr *invalidInputError
+	if errors.As(err, &invalidErr) {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Error saving config file")
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/")
+}
+
+// Returned when the settings given for something aren't valid
+type invalidInputError struct {
+	message string
+}
+
+func (e *invalidInputError) Error() string {
+	return e.message
+}
+
+// Check a blend's settings
+func validateBlend(blend config.Blend) error {
+	switch blend.Period {
+	case "weekly", "monthly":
+	default:
+		return &invalidInputError{"Invalid period given; must be weekly or monthly"}
+	}
+	switch blend.Strategy {
+	case config.BLEND_INTERLEAVE, config.BLEND_INTERSECTION, config.BLEND_PLAYCOUNT:
+	default:
+		return &invalidInputError{"Invalid strategy given; must be interleave, intersection or playcount"}
+	}
+	if len(blend.Usernames) < 2 {
+		return &invalidInputError{"A blend needs at least two lastfm usernames"}
+	}
+	if blend.MaxTracks < 0 || blend.MaxTracks > config.MAX_TRACKS {
+		return &invalidInputError{fmt.Sprintf("Invalid max tracks given; must be between 0 and %d", config.MAX_TRACKS)}
+	}
+
+	return nil
+}
+
+// Add an enabled blend and schedule its job.
+// A blend without a name is named after its users
+func createBlend(blend config.Blend) (config.Blend, error) {
+	err := validateBlend(blend)
+	if err != nil {
+		return blend, err
+	}
+	if blend.Name == "" {
+		blend.Name = strings.Join(blend.Usernames, " + ")
+	}
+	blend.Enabled = true
+
+	err = config.Update(func(conf *config.Config) error {
+		if conf.GetUser(blend.OwnerId) == nil {
+			return errNotFound
+		}
+		blend = *conf.AddBlend(blend)
+		return nil
+	})
+	if err != nil {
+		return blend, err
+	}
+	scheduler.StartBlendJob(blend.Id, blend.Period)
+
+	return blend, nil
+}
+
+// Parse a comma separated list of lastfm usernames, each optionally followed by a weight, e.g. "alice, bob:2"
+func parseBlendUsers(input string) ([]string, map[string]float64, error) {
+	var usernames []string
+	weights := make(map[string]float64)
+	for _, v := range splitTags(input) {
+		username, weightValue, hasWeight := strings.Cut(v, ":")
+		username = strings.TrimSpace(username)
+		if hasWeight {
+			weight, err := strconv.ParseFloat(strings.TrimSpace(weightValue), 64)
+			if err != nil || weight <= 0 {
+				return nil, nil, fmt.Errorf("invalid weight given for %s", username)
+			}
+			weights[username] = weight
+		}
+		usernames = append(usernames, username)
+	}
+
+	return usernames, weights, nil
+}
+
+// Enable or disable a blend's scheduled sync
+func toggleBlend(c *gin.Context) {
+	_, err := updateBlend(c.Param("blend"), func(blend *config.Blend) error {
+		blend.Enabled = !blend.Enabled
+		return nil
+	})
+	if err != nil {
+		respondUpdateError(c, err, "No such blend")
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/")
+}
+
+// Change a blend's settings, then start, stop or reschedule its job to match.
+// The blend's id and playlist can't be changed, and it must still belong to a user
+func updateBlend(blendId string, update func(blend *config.Blend) error) (config.Blend, error) {
+	var before, after config.Blend
+	err := config.Update(func(conf *config.Config) error {
+		blend := conf.GetBlend(blendId)
+		if blend == nil {
+			return errNotFound
+		}
+		before = *blend
+		err := update(blend)
+		if err != nil {
+			return err
+		}
+		blend.Id = before.Id
+		// The playlist is kept track of by the sync, and belongs to the owner's spotify account,
+		// so a new owner gets a new playlist on the next sync
+		blend.PlaylistId = before.PlaylistId
+		if blend.OwnerId != before.OwnerId {
+			blend.PlaylistId = ""
+		}
+		if conf.GetUser(blend.OwnerId) == nil {
+			return &invalidInputError{"No user with the given owner id"}
+		}
+		after = *blend
+		return validateBlend(after)
+	})
+	if err != nil {
+		return before, err
+	}
+
+	reconcileJobs()
+
+	return after, nil
+}
+
+// Remove a blend and its scheduled sync. The spotify playlist is left in place
+func deleteBlend(c *gin.Context) {
+	err := removeBlend(c.Param("blend"))
+	if err != nil {
+		respondUpdateError(c, err, "No such blend")
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/")
+}
+
+// Remove a blend and its scheduled sync
+func removeBlend(blendId string) error {
+	err := config.Update(func(conf *config.Config) error {
+		if !conf.RemoveBlend(blendId) {
+			return errNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	scheduler.StopBlendJob(blendId)
+
+	return nil
+}
+
+// Handle manually syncing a blend
+func handleBlendSync(c *gin.Context) {
+	blendId := c.Param("blend")
+	conf, err := config.LoadConfig(false)
+	if err != nil {
+		log.Error("Error reading config", "error", err)
+		c.String(http.StatusInternalServerError, "Error reading config file")
+		return
+	}
+	blend := conf.GetBlend(blendId)
+	if blend == nil {
+		c.String(http.StatusNotFound, "No such blend")
+		return
+	}
+
+	err = sync.SyncBlend(blendId)
+	if err != nil {
+		log.Error("Error running blend sync", "error", err)
+		if sync.FlagReauthRequired(blend.OwnerId, err) {
+			c.String(http.StatusUnauthorized, "Re-authorization required")
+			return
+		}
+		c.String(http.StatusInternalServerError, "Error running sync")
+		return
+	}
+
+	c.HTML(http.StatusOK, "partial/sync-manually", gin.H{"syncUrl": "/sync-blend/" + blendId})
+}
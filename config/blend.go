@@ -0,0 +1,69 @@
+package config
+
+// How the top tracks of each user in a blend are combined
+const (
+	// Take each user's top track in turn, then their second, and so on
+	BLEND_INTERLEAVE = "interleave"
+	// Only tracks every user has played, ordered by their combined playcount
+	BLEND_INTERSECTION = "intersection"
+	// All tracks, ordered by each user's playcount multiplied by their weight
+	BLEND_PLAYCOUNT = "playcount"
+)
+
+// A playlist merging the top tracks of several lastfm users for a period.
+// The playlist is created in the owner's spotify account and its contents are replaced on each sync
+type Blend struct {
+	Id      string `json:"id"`
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	// The user whose spotify account holds the playlist
+	OwnerId string `json:"owner_id"`
+	// The lastfm usernames to blend
+	Usernames []string `json:"usernames"`
+	// Only used with the playcount strategy. Users without a weight have a weight of 1
+	Weights map[string]float64 `json:"weights"`
+	// weekly or monthly
+	Period     string `json:"period"`
+	Strategy   string `json:"strategy"`
+	MaxTracks  int    `json:"max_tracks"`
+	PlaylistId string `json:"playlist_id"`
+}
+
+// Get a blend by id, or nil if there is no such blend
+func (c *Config) GetBlend(id string) *Blend {
+	for i := range c.Blends {
+		if c.Blends[i].Id == id {
+			return &c.Blends[i]
+		}
+	}
+
+	return nil
+}
+
+// Add a new blend, returning it
+func (c *Config) AddBlend(blend Blend) *Blend {
+	blend.Id = newId()
+	c.Blends = append(c.Blends, blend)
+	return &c.Blends[len(c.Blends)-1]
+}
+
+// Remove the blend with the given id, returning whether it existed
+func (c *Config) RemoveBlend(id string) bool {
+	for i := range c.Blends {
+		if c.Blends[i].Id == id {
+			c.Blends = append(c.Blends[:i], c.Blends[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// The weight of a user in the blend
+func (b *Blend) Weight(username string) float64 {
+	if weight, ok := b.Weights[username]; ok && weight > 0 {
+		return weight
+	}
+
+	return 1
+}
@@ -0,0 +1,48 @@
+package config
+
+import "slices"
+
+// Make a deep copy of the config, so it can be changed without affecting anyone else holding the original
+func (c *Config) Clone() *Config {
+	clone := *c
+	clone.Users = make([]User, len(c.Users))
+	for i, user := range c.Users {
+		clone.Users[i] = user.clone()
+	}
+	clone.Blends = make([]Blend, len(c.Blends))
+	for i, blend := range c.Blends {
+		clone.Blends[i] = blend.clone()
+	}
+	clone.Config.Security.TrustedProxies = slices.Clone(c.Config.Security.TrustedProxies)
+	clone.Config.Security.ApiTokens = slices.Clone(c.Config.Security.ApiTokens)
+
+	return &clone
+}
+
+func (u User) clone() User {
+	u.Sync.Weekly = u.Sync.Weekly.clone()
+	u.Sync.Monthly = u.Sync.Monthly.clone()
+	u.History = slices.Clone(u.History)
+
+	return u
+}
+
+func (p Period) clone() Period {
+	p.IncludeTags = slices.Clone(p.IncludeTags)
+	p.ExcludeTags = slices.Clone(p.ExcludeTags)
+
+	return p
+}
+
+func (b Blend) clone() Blend {
+	b.Usernames = slices.Clone(b.Usernames)
+	if b.Weights != nil {
+		weights := make(map[string]float64, len(b.Weights))
+		for k, v := range b.Weights {
+			weights[k] = v
+		}
+		b.Weights = weights
+	}
+
+	return b
+}
@@ -1,51 +1,230 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/charmbracelet/log"
 	"github.com/joho/godotenv"
 )
 
-type LastFMAuthData struct {
+// The api credentials for the lastfm app, shared by every user
+type LastFMAppData struct {
 	ApiKey       string `json:"api_key"`
 	SharedSecret string `json:"shared_secret"`
-	Username     string `json:"username"`
-	Token        string `json:"token"`
 }
 
+// The api credentials for the spotify app, shared by every user
+type SpotifyAppData struct {
+	ClientId     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+}
+
+// A user's lastfm account
+type LastFMAuthData struct {
+	Username string `json:"username"`
+	Token    string `json:"token"`
+	// Set when a sync fails because the session or api key is no longer valid
+	ReauthRequired bool `json:"reauth_required"`
+}
+
+// A user's spotify tokens
 type SpotifyAuthData struct {
 	AccessToken  string    `json:"access_token"`
 	RefreshToken string    `json:"refresh_token"`
 	ExpiresIn    int       `json:"expires_in"`
 	ExpiresAt    time.Time `json:"expires_at"`
-	ClientId     string    `json:"client_id"`
-	ClientSecret string    `json:"client_secret"`
+	// Whether the tokens were issued using PKCE, which changes how they need to be refreshed
+	Pkce bool `json:"pkce"`
+	// Set when a sync fails because spotify will no longer refresh the tokens
+	ReauthRequired bool `json:"reauth_required"`
 }
 
+// Where the tracks for a period's playlist come from
+const (
+	SOURCE_TOP_TRACKS  = "tracks"
+	SOURCE_TOP_ARTISTS = "artists"
+)
+
+// Where the tracks for each artist come from when using the top artists source
+const (
+	ARTIST_TRACKS_LASTFM  = "lastfm"
+	ARTIST_TRACKS_SPOTIFY = "spotify"
+)
+
 type Period struct {
 	Enabled   bool `json:"enabled"`
 	MaxTracks int  `json:"max_tracks"`
+	// One of the SOURCE_ values. Empty means top tracks
+	Source string `json:"source"`
+	// Only used with the top artists source
+	ArtistCount     int    `json:"artist_count"`
+	TracksPerArtist int    `json:"tracks_per_artist"`
+	ArtistTracks    string `json:"artist_tracks"`
+	// Only keep tracks tagged with at least one of the include tags, and none of the exclude tags.
+	// Tags with a weight (0-100) below the minimum are ignored
+	IncludeTags  []string `json:"include_tags"`
+	ExcludeTags  []string `json:"exclude_tags"`
+	MinTagWeight int      `json:"min_tag_weight"`
+	// Replace spotify's default cover with one generated from the top albums
+	CustomCover bool `json:"custom_cover"`
+}
+
+// Settings for keeping a single playlist in sync with the user's lastfm loved tracks
+type LovedSync struct {
+	Enabled       bool   `json:"enabled"`
+	MaxTracks     int    `json:"max_tracks"`
+	RemoveUnloved bool   `json:"remove_unloved"`
+	PlaylistId    string `json:"playlist_id"`
+}
+
+// Settings for building playlists of tracks similar to the user's top tracks that they haven't heard yet
+type DiscoverySync struct {
+	Enabled   bool `json:"enabled"`
+	MaxTracks int  `json:"max_tracks"`
+	// The period to take the seed tracks from; weekly or monthly
+	SeedPeriod string `json:"seed_period"`
+	SeedCount  int    `json:"seed_count"`
+	// The lastfm match score between 0 and 1 a similar track or artist needs to be included
+	MinSimilarity float64 `json:"min_similarity"`
+}
+
+// Settings for a playlist of tracks the user used to play a lot, but hasn't played recently
+type RediscoverySync struct {
+	Enabled   bool `json:"enabled"`
+	MaxTracks int  `json:"max_tracks"`
+	// Tracks played at all in this many months are left out
+	Months int `json:"months"`
+	// How many plays a track needs across the user's whole history to be included
+	MinPlaycount int    `json:"min_playcount"`
+	PlaylistId   string `json:"playlist_id"`
+}
+
+// Where the spotify tracks to love on lastfm are taken from
+const (
+	LIKED_SOURCE_LIBRARY  = "library"
+	LIKED_SOURCE_PLAYLIST = "playlist"
+)
+
+// Settings for loving tracks on lastfm once they are saved on spotify, the reverse of the loved sync
+type LikedSync struct {
+	Enabled bool `json:"enabled"`
+	// One of the LIKED_SOURCE_ values. Empty means the user's liked songs
+	Source string `json:"source"`
+	// Only used with the playlist source
+	PlaylistId string `json:"playlist_id"`
+	// Only tracks saved after the last sync are loved
+	LastSyncedAt time.Time `json:"last_synced_at"`
+}
+
+// Settings for scrobbling plays from spotify's recently played tracks that never reached lastfm
+type RecentlyPlayedSync struct {
+	Enabled bool `json:"enabled"`
+	// Only plays after the last poll are checked
+	LastPolledAt time.Time `json:"last_polled_at"`
+}
+
+// The sync settings for each of a user's jobs
+type SyncSettings struct {
+	Weekly      Period             `json:"weekly"`
+	Monthly     Period             `json:"monthly"`
+	Loved       LovedSync          `json:"loved"`
+	Discovery   DiscoverySync      `json:"discovery"`
+	Rediscovery RediscoverySync    `json:"rediscovery"`
+	Liked       LikedSync          `json:"liked"`
+	Recent      RecentlyPlayedSync `json:"recently_played"`
+}
+
+// Get the settings for one of the user's syncs, as a pointer to the settings struct, or nil if there is no such sync
+func (s *SyncSettings) ForPeriod(period string) any {
+	switch period {
+	case "weekly":
+		return &s.Weekly
+	case "monthly":
+		return &s.Monthly
+	case "loved":
+		return &s.Loved
+	case "discovery":
+		return &s.Discovery
+	case "rediscovery":
+		return &s.Rediscovery
+	case "liked":
+		return &s.Liked
+	case "recent":
+		return &s.Recent
+	}
+
+	return nil
 }
 
 type Config struct {
-	Auth struct {
-		LastFM  LastFMAuthData  `json:"last_fm"`
-		Spotify SpotifyAuthData `json:"spotify"`
+	// The version of the config file format. See CONFIG_VERSION
+	Version int `json:"version"`
+	Auth    struct {
+		LastFM  LastFMAppData  `json:"last_fm"`
+		Spotify SpotifyAppData `json:"spotify"`
 	} `json:"auth"`
+	Users  []User  `json:"users"`
+	Blends []Blend `json:"blends"`
 	Config struct {
-		Sync struct {
-			Weekly  Period `json:"weekly"`
-			Monthly Period `json:"monthly"`
-		} `json:"sync"`
+		Server   Server   `json:"server"`
+		Security Security `json:"security"`
 	} `json:"config"`
 }
 
-const FILENAME = "conf/config.json"
+// The default directory for the config file and the app's other state, relative to the working directory
+const DEFAULT_DATA_DIR = "conf"
+
+var (
+	dataDir = DEFAULT_DATA_DIR
+	// Empty to keep the config file in the data dir
+	configFilename = ""
+)
+
+// Set where the config file and the app's other state are kept. Must be called before the config is loaded.
+// An empty data dir uses the default, and an empty config filename keeps the config file in the data dir
+func SetPaths(dir string, filename string) {
+	if dir == "" {
+		dir = DEFAULT_DATA_DIR
+	}
+	dataDir = dir
+	configFilename = filename
+}
+
+// The path of the config file
+func Filename() string {
+	if configFilename != "" {
+		return configFilename
+	}
+	return filepath.Join(dataDir, "config.json")
+}
+
+// A copy of the config file from before the last write
+func BackupFilename() string {
+	return Filename() + ".bak"
+}
+
+// Where lastfm tags are cached between syncs
+func TagCacheFilename() string {
+	return filepath.Join(dataDir, "tags.json")
+}
+
+// Where the tracks already loved on lastfm by the liked sync are recorded
+func LovedStateFilename() string {
+	return filepath.Join(dataDir, "loved.json")
+}
+
+// Where the plays fetched by the rediscovery sync are cached between syncs
+func PlayHistoryFilename() string {
+	return filepath.Join(dataDir, "history.json")
+}
 
 var appEnv string = "NIL"
 
@@ -60,66 +239,288 @@ func IsDev() bool {
 	return appEnv == "dev" || appEnv == "development"
 }
 
+// The last config loaded or written. It is never changed in place; every change replaces it with a new copy
 var cachedData *Config
 
+// Guards cachedData and the config file
+var configLock sync.RWMutex
+
 // Load the config file.
-// Config will be loaded from cache unless force is true
+// Config will be loaded from cache unless force is true.
+// The config returned is a copy, so changes to it are only kept once passed to WriteConfig. Use Update to make
+// changes based on the current config, so they can't overwrite changes made elsewhere in the meantime
 func LoadConfig(force bool) (*Config, error) {
+	configLock.RLock()
+	if cachedData != nil && !force {
+		defer configLock.RUnlock()
+		return cachedData.Clone(), nil
+	}
+	configLock.RUnlock()
+
+	configLock.Lock()
+	defer configLock.Unlock()
+	data, err := loadLocked(force)
+	if err != nil {
+		return nil, err
+	}
+
+	return data.Clone(), nil
+}
+
+// Load the config into the cache if it isn't already.
+// configLock must be held for writing
+func loadLocked(force bool) (*Config, error) {
+	// Another caller may have loaded it while waiting for the lock
 	if cachedData != nil && !force {
 		return cachedData, nil
 	}
 
 	// Read the JSON file and unmarshal it into a struct
-	data, err := readConfigFile(FILENAME)
+	err := os.MkdirAll(dataDir, 0775)
+	if err != nil {
+		log.Error("Unable to create data dir", "dir", dataDir, "error", err)
+		return nil, err
+	}
+	data, migrated, err := readConfigFile(Filename())
+	if err != nil {
+		return nil, err
+	}
+	rewrite, err := decryptSecrets(data)
 	if err != nil {
+		log.Error("Error decrypting config", "error", err)
+		return nil, err
+	}
+	generated, err := ensureCookieSecret(data)
+	if err != nil {
+		log.Error("Unable to generate cookie secret", "error", err)
+		return nil, err
+	}
+	rewrite = rewrite || migrated || generated
+	ensureDefaultUser(data)
+	err = applyEnvOverrides(data, true)
+	if err != nil {
+		log.Error("Error applying env var overrides", "error", err)
 		return nil, err
 	}
 
 	// Cache the data
 	cachedData = data
+	fileStamp = configStamp()
+
+	for _, problem := range data.Validate() {
+		log.Warn("Config problem", "problem", problem)
+	}
+
+	// Save any migrations, and bring the secrets in the file in line with the current encryption key.
+	// It's written twice so the backup doesn't keep the secrets as they were either, and the backups from before
+	// any migrations are removed once the secrets are encrypted
+	if rewrite {
+		log.Info("Updating config file")
+		for i := 0; i < 2; i++ {
+			err = writeLocked(data.Clone())
+			if err != nil {
+				return nil, err
+			}
+		}
+		if currentKey != nil {
+			removeVersionBackups(Filename())
+		}
+		return cachedData, nil
+	}
 
 	return data, nil
 }
 
-func readConfigFile(filename string) (*Config, error) {
-	var config Config
+// Apply a change to the current config and save it.
+// The config is locked until the change is written, so update must not load or write the config itself.
+// If update returns an error, nothing is saved and the error is returned
+func Update(update func(conf *Config) error) error {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	current, err := loadLocked(false)
+	if err != nil {
+		return err
+	}
+	data := current.Clone()
+	err = update(data)
+	if err != nil {
+		return err
+	}
+
+	return writeLocked(data)
+}
+
+// Read and decode the config file, migrating it to the current version.
+// Returns whether it was migrated, in which case it needs saving
+func readConfigFile(filename string) (*Config, bool, error) {
+	config := Config{Version: CONFIG_VERSION}
 
 	err := os.MkdirAll(filepath.Dir(filename), 0775)
 	if err != nil {
 		log.Error(err)
-		return nil, err
+		return nil, false, err
 	}
 
-	configFile, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0660)
+	configFile, err := os.OpenFile(filename, os.O_CREATE|os.O_RDONLY, 0660)
 	if err != nil {
 		log.Error(err)
-		return nil, err
+		return nil, false, err
 	}
 	defer configFile.Close()
 
-	jsonParser := json.NewDecoder(configFile)
-	jsonParser.Decode(&config)
+	raw, err := io.ReadAll(configFile)
+	if err != nil {
+		log.Error(err)
+		return nil, false, err
+	}
+	// A new install starts with an empty file
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return &config, false, nil
+	}
+
+	raw, migrated, err := migrateConfig(raw, filename)
+	if err == nil {
+		err = json.Unmarshal(raw, &config)
+	}
+	if err != nil {
+		log.Error("Unable to read config file", "file", filename, "backup", filename+".bak", "error", err)
+		return nil, false, fmt.Errorf("unable to read %s, the last working config is in %s.bak: %w", filename, filename, err)
+	}
 
-	return &config, nil
+	// Settings under keys the app doesn't know about would be silently dropped on the next save
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&Config{}); err != nil {
+		log.Warn("Config file has settings that will be ignored", "error", err)
+	}
+
+	return &config, migrated, nil
 }
 
+// Write the config to file.
+// The config is written to a temp file first then renamed over the original, so a failed write can't
+// leave the config (and any rotated tokens in it) half written
 func WriteConfig(data *Config) error {
-	// Create or open a file for writing.
-	file, err := os.Create(FILENAME)
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	return writeLocked(data.Clone())
+}
+
+// Write the config to file and make it the cached config. The caller must not change data afterwards.
+// configLock must be held for writing
+func writeLocked(data *Config) error {
+	filename := Filename()
+
+	// Settings from env vars stay out of the file, and can't be changed by anything else
+	fileData := data.Clone()
+	fileData.Version = CONFIG_VERSION
+	removeEnvOverrides(fileData)
+	err := applyEnvOverrides(data, false)
+	if err != nil {
+		log.Error("Error applying env var overrides", "error", err)
+		return err
+	}
+	err = encryptSecrets(fileData)
+	if err != nil {
+		log.Error("Error encrypting config secrets", "error", err)
+		return err
+	}
+
+	// Create a temp file next to the config file for writing.
+	file, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
 	if err != nil {
 		log.Error("Error creating file", "error", err)
 		return err
 	}
-	defer file.Close() // Ensure the file is closed when we're done.
+	defer os.Remove(file.Name()) // Clean up the temp file if the rename doesn't happen
+	file.Chmod(0660)
 
 	// Create a JSON encoder and encode the struct into JSON format.
 	encoder := json.NewEncoder(file)
-	err = encoder.Encode(data)
+	err = encoder.Encode(fileData)
 	if err != nil {
+		file.Close()
 		log.Error("Error encoding JSON:", "error", err)
 		return err
 	}
+	// Make sure the new config is on disk before it replaces the old one
+	err = file.Sync()
+	if err != nil {
+		file.Close()
+		log.Error("Error syncing file", "error", err)
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		log.Error("Error closing file", "error", err)
+		return err
+	}
 
-	log.Info("JSON data written to " + FILENAME)
+	backupConfig()
+	err = os.Rename(file.Name(), filename)
+	if err != nil {
+		log.Error("Error replacing config file", "error", err)
+		return err
+	}
+	syncDir(filepath.Dir(filename))
+	cachedData = data
+	fileStamp = configStamp()
+
+	log.Info("JSON data written to " + filename)
 	return nil
 }
+
+// Copy the current config file to the backup before it is replaced.
+// Only a config that can be read is backed up, so the backup is always the last working config
+func backupConfig() {
+	raw, err := os.ReadFile(Filename())
+	if err != nil || !json.Valid(raw) {
+		return
+	}
+
+	err = WriteFileAtomic(BackupFilename(), raw)
+	if err != nil {
+		log.Warn("Unable to back up config", "error", err)
+	}
+}
+
+// Write a file next to where it belongs then rename it into place, so a crash part way through
+// leaves either the old file or the new one, never one that is half written
+func WriteFileAtomic(filename string, data []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name()) // Clean up the temp file if the rename doesn't happen
+	file.Chmod(0660)
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(file.Name(), filename)
+	if err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(filename))
+
+	return nil
+}
+
+// Flush a directory, so a file renamed into it survives a crash
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	d.Sync()
+}
@@ -0,0 +1,181 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/charmbracelet/log"
+)
+
+// The prefix of encrypted values in the config file, followed by the key id and the encrypted value
+const ENCRYPTED_PREFIX = "enc:v1:"
+
+// A key used to encrypt secrets in the config file
+type encryptionKey struct {
+	// Stored alongside each encrypted value, so the right key can be picked when there are old keys
+	Id   string
+	aead cipher.AEAD
+}
+
+// The keys read from the env. The current key is used for all writes; old keys can only decrypt
+var (
+	keysLoaded bool
+	currentKey *encryptionKey
+	oldKeys    []*encryptionKey
+)
+
+// Make an encryption key from a passphrase.
+// The passphrase should be long and random, e.g. from `openssl rand -base64 32`
+func newEncryptionKey(passphrase string) (*encryptionKey, error) {
+	key := sha256.Sum256([]byte(passphrase))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	id := sha256.Sum256(key[:])
+
+	return &encryptionKey{Id: hex.EncodeToString(id[:4]), aead: aead}, nil
+}
+
+// Read the encryption keys from SYNCER_ENCRYPTION_KEY and the comma separated SYNCER_ENCRYPTION_OLD_KEYS
+func loadEncryptionKeys() error {
+	if keysLoaded {
+		return nil
+	}
+
+	passphrase, ok, err := lookupEnv("ENCRYPTION_KEY")
+	if err != nil {
+		return err
+	}
+	if ok && passphrase != "" {
+		currentKey, err = newEncryptionKey(passphrase)
+		if err != nil {
+			return err
+		}
+	}
+
+	oldPassphrases, _, err := lookupEnv("ENCRYPTION_OLD_KEYS")
+	if err != nil {
+		return err
+	}
+	for _, v := range strings.Split(oldPassphrases, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		key, err := newEncryptionKey(v)
+		if err != nil {
+			return err
+		}
+		oldKeys = append(oldKeys, key)
+	}
+
+	keysLoaded = true
+	return nil
+}
+
+// The config fields holding secrets. Only these are encrypted, so the rest of the config stays readable
+func secretFields(c *Config) []*string {
+	fields := []*string{&c.Auth.LastFM.SharedSecret, &c.Auth.Spotify.ClientSecret, &c.Config.Security.CookieSecret}
+	for i := range c.Users {
+		user := &c.Users[i]
+		fields = append(fields, &user.LastFM.Token, &user.Spotify.AccessToken, &user.Spotify.RefreshToken)
+	}
+
+	return fields
+}
+
+// Encrypt the secrets in the config with the current key. Without a key they are left as they are.
+// configLock must be held
+func encryptSecrets(c *Config) error {
+	err := loadEncryptionKeys()
+	if err != nil || currentKey == nil {
+		return err
+	}
+
+	for _, field := range secretFields(c) {
+		if *field == "" {
+			continue
+		}
+		nonce := make([]byte, currentKey.aead.NonceSize())
+		_, err := rand.Read(nonce)
+		if err != nil {
+			return err
+		}
+		sealed := currentKey.aead.Seal(nonce, nonce, []byte(*field), nil)
+		*field = ENCRYPTED_PREFIX + currentKey.Id + ":" + base64.StdEncoding.EncodeToString(sealed)
+	}
+
+	return nil
+}
+
+// Decrypt any encrypted secrets in the config.
+// Returns whether any secrets need to be written again, because they were encrypted with an old key, or not
+// encrypted at all now there is a key, or encrypted when there no longer is one.
+// configLock must be held
+func decryptSecrets(c *Config) (bool, error) {
+	err := loadEncryptionKeys()
+	if err != nil {
+		return false, err
+	}
+
+	rewrite := false
+	for _, field := range secretFields(c) {
+		if *field == "" {
+			continue
+		}
+		if !strings.HasPrefix(*field, ENCRYPTED_PREFIX) {
+			rewrite = rewrite || currentKey != nil
+			continue
+		}
+
+		keyId, encoded, _ := strings.Cut(strings.TrimPrefix(*field, ENCRYPTED_PREFIX), ":")
+		key := findKey(keyId)
+		if key == nil {
+			if currentKey == nil && len(oldKeys) == 0 {
+				return false, errors.New("the config has encrypted secrets but no SYNCER_ENCRYPTION_KEY is set")
+			}
+			return false, fmt.Errorf("the config's secrets were encrypted with a different key (id %s) to SYNCER_ENCRYPTION_KEY. Add the old key to SYNCER_ENCRYPTION_OLD_KEYS to rotate to the new one", keyId)
+		}
+
+		sealed, err := base64.StdEncoding.DecodeString(encoded)
+		nonceSize := key.aead.NonceSize()
+		if err != nil || len(sealed) < nonceSize {
+			return false, errors.New("an encrypted secret in the config is corrupt")
+		}
+		plain, err := key.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+		if err != nil {
+			return false, fmt.Errorf("unable to decrypt a secret in the config with key %s: %w", keyId, err)
+		}
+
+		*field = string(plain)
+		rewrite = rewrite || key != currentKey
+	}
+
+	return rewrite, nil
+}
+
+// Find the current or old key with the given id
+func findKey(id string) *encryptionKey {
+	if currentKey != nil && currentKey.Id == id {
+		return currentKey
+	}
+	for _, key := range oldKeys {
+		if key.Id == id {
+			log.Debug("Decrypting with an old key", "key", id)
+			return key
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,393 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/charmbracelet/log"
+)
+
+// The prefix for env vars overriding the config file
+const ENV_PREFIX = "SYNCER_"
+
+// A config setting that can be set with an env var instead of in the config file.
+// Each can also be read from a file, e.g. a docker or kubernetes secret, by setting the env var with a _FILE suffix
+type envOverride struct {
+	// The env var name, without the prefix
+	Name string
+	// The field's id in the web UI, if it is set with a field in the credentials or server settings
+	Field string
+	get   func(c *Config) string
+	set   func(c *Config, value string) error
+}
+
+func valueOverride[T any](name string, field string, value func(c *Config) *T, parse func(v string) (T, error), format func(v T) string) envOverride {
+	return envOverride{
+		Name:  name,
+		Field: field,
+		get:   func(c *Config) string { return format(*value(c)) },
+		set: func(c *Config, v string) error {
+			parsed, err := parse(v)
+			if err != nil {
+				return err
+			}
+			*value(c) = parsed
+			return nil
+		},
+	}
+}
+
+func stringOverride(name string, field string, value func(c *Config) *string) envOverride {
+	return valueOverride(name, field, value, func(v string) (string, error) { return v, nil }, func(v string) string { return v })
+}
+
+func intOverride(name string, field string, value func(c *Config) *int) envOverride {
+	return valueOverride(name, field, value, func(v string) (int, error) {
+		parsed, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return 0, fmt.Errorf("invalid number %s", v)
+		}
+		return parsed, nil
+	}, strconv.Itoa)
+}
+
+func floatOverride(name string, field string, value func(c *Config) *float64) envOverride {
+	return valueOverride(name, field, value, func(v string) (float64, error) {
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number %s", v)
+		}
+		return parsed, nil
+	}, func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) })
+}
+
+func boolOverride(name string, field string, value func(c *Config) *bool) envOverride {
+	return valueOverride(name, field, value, func(v string) (bool, error) {
+		parsed, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return false, fmt.Errorf("invalid boolean %s, must be true or false", v)
+		}
+		return parsed, nil
+	}, strconv.FormatBool)
+}
+
+// A comma separated list
+func listOverride(name string, field string, value func(c *Config) *[]string) envOverride {
+	return valueOverride(name, field, value, func(v string) ([]string, error) {
+		var list []string
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return list, nil
+	}, func(v []string) string { return strings.Join(v, ",") })
+}
+
+// Every setting in the config that isn't specific to a user or blend
+var envOverrides = []envOverride{
+	stringOverride("LASTFM_API_KEY", "lastfm-api-key", func(c *Config) *string { return &c.Auth.LastFM.ApiKey }),
+	stringOverride("LASTFM_SHARED_SECRET", "lastfm-shared-secret", func(c *Config) *string { return &c.Auth.LastFM.SharedSecret }),
+	stringOverride("SPOTIFY_CLIENT_ID", "spotify-client-id", func(c *Config) *string { return &c.Auth.Spotify.ClientId }),
+	stringOverride("SPOTIFY_CLIENT_SECRET", "spotify-client-secret", func(c *Config) *string { return &c.Auth.Spotify.ClientSecret }),
+	stringOverride("BASE_URL", "base-url", func(c *Config) *string { return &c.Config.Server.BaseUrl }),
+	stringOverride("LISTEN_ADDRESS", "listen-address", func(c *Config) *string { return &c.Config.Server.ListenAddress }),
+	intOverride("PORT", "port", func(c *Config) *int { return &c.Config.Server.Port }),
+	stringOverride("TLS_CERT_FILE", "tls-cert-file", func(c *Config) *string { return &c.Config.Server.TlsCertFile }),
+	stringOverride("TLS_KEY_FILE", "tls-key-file", func(c *Config) *string { return &c.Config.Server.TlsKeyFile }),
+	stringOverride("ADMIN_PASSWORD_HASH", "admin-password-hash", func(c *Config) *string { return &c.Config.Security.PasswordHash }),
+	stringOverride("PROXY_AUTH_HEADER", "proxy-auth-header", func(c *Config) *string { return &c.Config.Security.ProxyAuthHeader }),
+	listOverride("TRUSTED_PROXIES", "trusted-proxies", func(c *Config) *[]string { return &c.Config.Security.TrustedProxies }),
+}
+
+// The prefixes of the env vars for each user's and blend's settings, followed by the id, e.g. SYNCER_USER_DEFAULT_WEEKLY_ENABLED
+const (
+	USER_ENV_PREFIX  = "USER_"
+	BLEND_ENV_PREFIX = "BLEND_"
+)
+
+// Format an id for use in an env var name
+func envId(id string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, id)
+}
+
+// The settings of a user that can be overridden. The playlists, tokens and times the app keeps track of can't be
+func userEnvOverrides(userId string) []envOverride {
+	prefix := USER_ENV_PREFIX + envId(userId) + "_"
+	user := func(c *Config) *User { return c.GetUser(userId) }
+	overrides := []envOverride{
+		stringOverride(prefix+"NAME", "", func(c *Config) *string { return &user(c).Name }),
+		stringOverride(prefix+"LASTFM_USERNAME", "", func(c *Config) *string { return &user(c).LastFM.Username }),
+	}
+
+	for _, job := range []string{"weekly", "monthly"} {
+		job := job
+		jobPrefix := prefix + strings.ToUpper(job) + "_"
+		period := func(c *Config) *Period { return user(c).Sync.ForPeriod(job).(*Period) }
+		overrides = append(overrides,
+			boolOverride(jobPrefix+"ENABLED", "", func(c *Config) *bool { return &period(c).Enabled }),
+			intOverride(jobPrefix+"MAX_TRACKS", "", func(c *Config) *int { return &period(c).MaxTracks }),
+			stringOverride(jobPrefix+"SOURCE", "", func(c *Config) *string { return &period(c).Source }),
+			intOverride(jobPrefix+"ARTIST_COUNT", "", func(c *Config) *int { return &period(c).ArtistCount }),
+			intOverride(jobPrefix+"TRACKS_PER_ARTIST", "", func(c *Config) *int { return &period(c).TracksPerArtist }),
+			stringOverride(jobPrefix+"ARTIST_TRACKS", "", func(c *Config) *string { return &period(c).ArtistTracks }),
+			listOverride(jobPrefix+"INCLUDE_TAGS", "", func(c *Config) *[]string { return &period(c).IncludeTags }),
+			listOverride(jobPrefix+"EXCLUDE_TAGS", "", func(c *Config) *[]string { return &period(c).ExcludeTags }),
+			intOverride(jobPrefix+"MIN_TAG_WEIGHT", "", func(c *Config) *int { return &period(c).MinTagWeight }),
+			boolOverride(jobPrefix+"CUSTOM_COVER", "", func(c *Config) *bool { return &period(c).CustomCover }),
+		)
+	}
+
+	sync := func(c *Config) *SyncSettings { return &user(c).Sync }
+	return append(overrides,
+		boolOverride(prefix+"LOVED_ENABLED", "", func(c *Config) *bool { return &sync(c).Loved.Enabled }),
+		intOverride(prefix+"LOVED_MAX_TRACKS", "", func(c *Config) *int { return &sync(c).Loved.MaxTracks }),
+		boolOverride(prefix+"LOVED_REMOVE_UNLOVED", "", func(c *Config) *bool { return &sync(c).Loved.RemoveUnloved }),
+		boolOverride(prefix+"DISCOVERY_ENABLED", "", func(c *Config) *bool { return &sync(c).Discovery.Enabled }),
+		intOverride(prefix+"DISCOVERY_MAX_TRACKS", "", func(c *Config) *int { return &sync(c).Discovery.MaxTracks }),
+		stringOverride(prefix+"DISCOVERY_SEED_PERIOD", "", func(c *Config) *string { return &sync(c).Discovery.SeedPeriod }),
+		intOverride(prefix+"DISCOVERY_SEED_COUNT", "", func(c *Config) *int { return &sync(c).Discovery.SeedCount }),
+		floatOverride(prefix+"DISCOVERY_MIN_SIMILARITY", "", func(c *Config) *float64 { return &sync(c).Discovery.MinSimilarity }),
+		boolOverride(prefix+"REDISCOVERY_ENABLED", "", func(c *Config) *bool { return &sync(c).Rediscovery.Enabled }),
+		intOverride(prefix+"REDISCOVERY_MAX_TRACKS", "", func(c *Config) *int { return &sync(c).Rediscovery.MaxTracks }),
+		intOverride(prefix+"REDISCOVERY_MONTHS", "", func(c *Config) *int { return &sync(c).Rediscovery.Months }),
+		intOverride(prefix+"REDISCOVERY_MIN_PLAYCOUNT", "", func(c *Config) *int { return &sync(c).Rediscovery.MinPlaycount }),
+		boolOverride(prefix+"LIKED_ENABLED", "", func(c *Config) *bool { return &sync(c).Liked.Enabled }),
+		stringOverride(prefix+"LIKED_SOURCE", "", func(c *Config) *string { return &sync(c).Liked.Source }),
+		stringOverride(prefix+"LIKED_PLAYLIST_ID", "", func(c *Config) *string { return &sync(c).Liked.PlaylistId }),
+		boolOverride(prefix+"RECENT_ENABLED", "", func(c *Config) *bool { return &sync(c).Recent.Enabled }),
+	)
+}
+
+// The settings of a blend that can be overridden. The owner can't be, as changing it needs a new playlist
+func blendEnvOverrides(blendId string) []envOverride {
+	prefix := BLEND_ENV_PREFIX + envId(blendId) + "_"
+	blend := func(c *Config) *Blend { return c.GetBlend(blendId) }
+
+	return []envOverride{
+		stringOverride(prefix+"NAME", "", func(c *Config) *string { return &blend(c).Name }),
+		boolOverride(prefix+"ENABLED", "", func(c *Config) *bool { return &blend(c).Enabled }),
+		listOverride(prefix+"USERNAMES", "", func(c *Config) *[]string { return &blend(c).Usernames }),
+		valueOverride(prefix+"WEIGHTS", "", func(c *Config) *map[string]float64 { return &blend(c).Weights }, parseWeights, formatWeights),
+		stringOverride(prefix+"PERIOD", "", func(c *Config) *string { return &blend(c).Period }),
+		stringOverride(prefix+"STRATEGY", "", func(c *Config) *string { return &blend(c).Strategy }),
+		intOverride(prefix+"MAX_TRACKS", "", func(c *Config) *int { return &blend(c).MaxTracks }),
+	}
+}
+
+// Parse blend weights given as a comma separated list of username:weight, e.g. alice:1,bob:2
+func parseWeights(v string) (map[string]float64, error) {
+	weights := make(map[string]float64)
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		username, weightValue, _ := strings.Cut(item, ":")
+		weight, err := strconv.ParseFloat(strings.TrimSpace(weightValue), 64)
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("invalid weight given for %s", username)
+		}
+		weights[strings.TrimSpace(username)] = weight
+	}
+
+	return weights, nil
+}
+
+func formatWeights(weights map[string]float64) string {
+	var items []string
+	for username, weight := range weights {
+		items = append(items, username+":"+strconv.FormatFloat(weight, 'f', -1, 64))
+	}
+	sort.Strings(items)
+
+	return strings.Join(items, ",")
+}
+
+// All the settings that can be overridden in the config, including those for each of its users and blends
+func (c *Config) envOverrides() []envOverride {
+	overrides := slices.Clone(envOverrides)
+	for _, user := range c.Users {
+		overrides = append(overrides, userEnvOverrides(user.Id)...)
+	}
+	for _, blend := range c.Blends {
+		overrides = append(overrides, blendEnvOverrides(blend.Id)...)
+	}
+
+	return overrides
+}
+
+// The values set by env vars, keyed by the env var name without the prefix
+var envValues map[string]string
+
+// The server settings could be set with these unprefixed env vars before the SYNCER_ ones were added.
+// They still work when the SYNCER_ one isn't set
+var deprecatedEnvNames = []string{"BASE_URL", "LISTEN_ADDRESS", "PORT", "TLS_CERT_FILE", "TLS_KEY_FILE"}
+
+// The settings whose value came from one of the deprecated env vars
+var deprecatedEnvUsed = make(map[string]bool)
+
+// The values in the config file for the settings overridden by env vars, so they can be written back unchanged
+var fileValues = make(map[string]string)
+
+// Read the values of every SYNCER_ env var, as which users and blends they override isn't known until the config is read
+func readEnvOverrides() (map[string]string, error) {
+	values := make(map[string]string)
+	for _, env := range os.Environ() {
+		name, _, _ := strings.Cut(env, "=")
+		name, ok := strings.CutPrefix(name, ENV_PREFIX)
+		if !ok {
+			continue
+		}
+		name = strings.TrimSuffix(name, "_FILE")
+		value, ok, err := lookupEnv(name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			values[name] = value
+		}
+	}
+
+	for _, name := range deprecatedEnvNames {
+		if _, ok := values[name]; ok {
+			continue
+		}
+		if value := os.Getenv(name); value != "" {
+			log.Warn("Env var is deprecated, use the prefixed one instead", "env", name, "use", ENV_PREFIX+name)
+			values[name] = value
+			deprecatedEnvUsed[name] = true
+		}
+	}
+
+	return values, nil
+}
+
+// The env var a setting's value was read from, given the name without the prefix
+func envVarName(name string) string {
+	if deprecatedEnvUsed[name] {
+		return name
+	}
+
+	return ENV_PREFIX + name
+}
+
+// Get the value of a SYNCER_ env var, or the contents of the file named by its _FILE variant.
+// The env var name is given without the prefix
+func lookupEnv(name string) (string, bool, error) {
+	name = ENV_PREFIX + name
+	if value, ok := os.LookupEnv(name); ok {
+		return value, true, nil
+	}
+
+	filename, ok := os.LookupEnv(name + "_FILE")
+	if !ok {
+		return "", false, nil
+	}
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		log.Error("Unable to read env var file", "env", name+"_FILE", "error", err)
+		return "", false, fmt.Errorf("unable to read %s_FILE: %w", name, err)
+	}
+
+	return strings.TrimRight(string(raw), "\r\n"), true, nil
+}
+
+// Replace the settings read from the config file with any env var overrides.
+// configLock must be held for writing
+func applyEnvOverrides(c *Config, fromFile bool) error {
+	if envValues == nil {
+		values, err := readEnvOverrides()
+		if err != nil {
+			return err
+		}
+		envValues = values
+	}
+
+	known := make(map[string]bool)
+	for _, override := range c.envOverrides() {
+		known[override.Name] = true
+		value, ok := envValues[override.Name]
+		if !ok {
+			continue
+		}
+		// Users and blends added since the file was read keep the value they were added with in the file
+		if _, recorded := fileValues[override.Name]; fromFile || !recorded {
+			fileValues[override.Name] = override.get(c)
+		}
+		err := override.set(c, value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", envVarName(override.Name), err)
+		}
+	}
+
+	if fromFile {
+		for name := range envValues {
+			if !known[name] && (strings.HasPrefix(name, USER_ENV_PREFIX) || strings.HasPrefix(name, BLEND_ENV_PREFIX)) {
+				log.Warn("Env var doesn't match the setting of any user or blend, so is ignored", "env", ENV_PREFIX+name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Put back the config file's own values for any settings overridden by env vars, so they are never written to the file.
+// configLock must be held
+func removeEnvOverrides(c *Config) {
+	for _, override := range c.envOverrides() {
+		if _, ok := envValues[override.Name]; !ok {
+			continue
+		}
+		if value, ok := fileValues[override.Name]; ok {
+			override.set(c, value)
+		}
+	}
+}
+
+// Get the env vars overriding the settings of a user, and of the blends they own
+func UserEnvOverrides(c *Config, userId string) []string {
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	overrides := userEnvOverrides(userId)
+	for _, blend := range c.Blends {
+		if blend.OwnerId == userId {
+			overrides = append(overrides, blendEnvOverrides(blend.Id)...)
+		}
+	}
+	var names []string
+	for _, override := range overrides {
+		if _, ok := envValues[override.Name]; ok {
+			names = append(names, ENV_PREFIX+override.Name)
+		}
+	}
+
+	return names
+}
+
+// Get the env var that sets a field in the web UI, or an empty string if the field isn't set by one
+func EnvOverride(field string) string {
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	for _, override := range envOverrides {
+		if override.Field != field {
+			continue
+		}
+		if _, ok := envValues[override.Name]; ok {
+			return envVarName(override.Name)
+		}
+	}
+
+	return ""
+}
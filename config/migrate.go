@@ -0,0 +1,141 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/charmbracelet/log"
+)
+
+// The version of the config file format written by this version of the app
+const CONFIG_VERSION = 1
+
+// Each migration upgrades the raw JSON of the config file from the version at its index to the next version.
+// Migrations work on the raw JSON so renamed or moved keys can be carried over before the config is decoded
+var migrations = []func(raw map[string]any) error{
+	migrateLegacyUser,
+}
+
+// Bring the raw JSON of a config file up to the current version, returning the migrated JSON and whether anything
+// changed. The file is backed up before it is migrated
+func migrateConfig(raw []byte, filename string) ([]byte, bool, error) {
+	var data map[string]any
+	err := json.Unmarshal(raw, &data)
+	if err != nil {
+		return nil, false, err
+	}
+
+	version := 0
+	if v, ok := data["version"].(float64); ok {
+		version = int(v)
+	}
+	if version > CONFIG_VERSION {
+		return nil, false, fmt.Errorf("%s is version %d, but this version of the app only understands up to version %d", filename, version, CONFIG_VERSION)
+	}
+	if version == CONFIG_VERSION {
+		return raw, false, nil
+	}
+
+	backupFilename := fmt.Sprintf("%s.v%d.bak", filename, version)
+	err = WriteFileAtomic(backupFilename, raw)
+	if err != nil {
+		log.Error("Unable to back up config before migrating", "error", err)
+		return nil, false, err
+	}
+
+	for ; version < CONFIG_VERSION; version++ {
+		log.Info("Migrating config", "from", version, "to", version+1, "backup", backupFilename)
+		err = migrations[version](data)
+		if err != nil {
+			return nil, false, fmt.Errorf("unable to migrate config from version %d: %w", version, err)
+		}
+		data["version"] = version + 1
+	}
+
+	migrated, err := json.Marshal(data)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return migrated, true, nil
+}
+
+// Remove the copies of the config file made before it was migrated.
+// They are in the old format so can't be encrypted, and would otherwise keep secrets unencrypted after
+// encryption is turned on
+func removeVersionBackups(filename string) {
+	entries, err := os.ReadDir(filepath.Dir(filename))
+	if err != nil {
+		return
+	}
+
+	prefix := filepath.Base(filename) + ".v"
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".bak") {
+			continue
+		}
+		backupFilename := filepath.Join(filepath.Dir(filename), name)
+		err := os.Remove(backupFilename)
+		if err != nil {
+			log.Warn("Unable to remove unencrypted config backup", "file", backupFilename, "error", err)
+			continue
+		}
+		log.Info("Removed config backup, as it isn't encrypted", "file", backupFilename)
+	}
+}
+
+// Get a nested JSON object, creating it if it doesn't exist
+func jsonObject(parent map[string]any, key string) map[string]any {
+	child, ok := parent[key].(map[string]any)
+	if !ok {
+		child = make(map[string]any)
+		parent[key] = child
+	}
+
+	return child
+}
+
+// Move the given keys from one JSON object to another, if they are set
+func moveKeys(from map[string]any, to map[string]any, keys ...string) {
+	for _, key := range keys {
+		if value, ok := from[key]; ok {
+			to[key] = value
+			delete(from, key)
+		}
+	}
+}
+
+// Version 0 to 1.
+// Before multiple users were supported, the user's accounts and sync settings were stored alongside the app credentials.
+// If the config is in that format, move them into a default user
+func migrateLegacyUser(raw map[string]any) error {
+	if users, ok := raw["users"].([]any); ok && len(users) > 0 {
+		return nil
+	}
+
+	auth := jsonObject(raw, "auth")
+	lastFm := jsonObject(auth, "last_fm")
+	spotify := jsonObject(auth, "spotify")
+	settings := jsonObject(raw, "config")
+	if lastFm["username"] == nil && spotify["refresh_token"] == nil {
+		return nil
+	}
+
+	log.Info("Moving existing accounts and sync settings into the default user")
+	user := map[string]any{
+		"id":      DEFAULT_USER_ID,
+		"name":    "Default",
+		"last_fm": map[string]any{},
+		"spotify": map[string]any{},
+	}
+	moveKeys(lastFm, user["last_fm"].(map[string]any), "username", "token", "reauth_required")
+	moveKeys(spotify, user["spotify"].(map[string]any), "access_token", "refresh_token", "expires_in", "expires_at", "pkce", "reauth_required")
+	moveKeys(settings, user, "sync")
+	raw["users"] = []any{user}
+
+	return nil
+}
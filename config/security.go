@@ -0,0 +1,179 @@
+package config
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The prefix given to api tokens, so they are easy to spot if leaked
+const API_TOKEN_PREFIX = "syncer_"
+
+// How many random bytes make up the cookie secret
+const COOKIE_SECRET_LENGTH = 32
+
+// Settings for protecting the web UI and api.
+// With neither a password nor a proxy auth header set, anyone who can reach the app can use it
+type Security struct {
+	// A bcrypt hash of the admin password. Set with the --set-password flag. Env: SYNCER_ADMIN_PASSWORD_HASH
+	PasswordHash string `json:"password_hash"`
+	// Trust this header, e.g. Remote-User, to name the signed in user when the request comes from a trusted proxy.
+	// Env: SYNCER_PROXY_AUTH_HEADER
+	ProxyAuthHeader string `json:"proxy_auth_header"`
+	// The ips or cidr ranges of the proxies allowed to set the proxy auth header. Empty only trusts localhost.
+	// Env: SYNCER_TRUSTED_PROXIES, comma separated
+	TrustedProxies []string `json:"trusted_proxies"`
+	// Tokens for using the api from scripts
+	ApiTokens []ApiToken `json:"api_tokens"`
+	// The key used to sign session and oauth cookies, generated on first start
+	CookieSecret string `json:"cookie_secret"`
+	// Sessions are signed with this, and it is changed on sign out to end every session
+	SessionGeneration int `json:"session_generation"`
+}
+
+// A token for the api. Only a hash of the token is kept, so it can't be read back out of the config
+type ApiToken struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Whether signing in is required to use the app
+func (s *Security) AuthEnabled() bool {
+	return s.PasswordHash != "" || s.ProxyAuthHeader != ""
+}
+
+// Set the admin password, replacing any existing one
+func (s *Security) SetPassword(password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	s.PasswordHash = string(hash)
+
+	return nil
+}
+
+// Check a password against the admin password
+func (s *Security) CheckPassword(password string) bool {
+	if s.PasswordHash == "" {
+		return false
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(s.PasswordHash), []byte(password)) == nil
+}
+
+// The key used to sign cookies, or nil if there isn't a valid one
+func (s *Security) CookieKey() []byte {
+	key, err := hex.DecodeString(s.CookieSecret)
+	if err != nil || len(key) < COOKIE_SECRET_LENGTH {
+		return nil
+	}
+
+	return key
+}
+
+// End every session, so everyone has to sign in again
+func (s *Security) EndSessions() {
+	s.SessionGeneration++
+}
+
+// Generate the cookie secret if there isn't a valid one yet, returning whether it was generated
+func ensureCookieSecret(conf *Config) (bool, error) {
+	security := &conf.Config.Security
+	if security.CookieKey() != nil {
+		return false, nil
+	}
+
+	key := make([]byte, COOKIE_SECRET_LENGTH)
+	_, err := rand.Read(key)
+	if err != nil {
+		return false, err
+	}
+	security.CookieSecret = hex.EncodeToString(key)
+
+	return true, nil
+}
+
+// Whether the proxy auth header can be trusted on a request from the given ip
+func (s *Security) IsTrustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	if len(s.TrustedProxies) == 0 {
+		return addr.IsLoopback()
+	}
+
+	for _, proxy := range s.TrustedProxies {
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(addr) {
+				return true
+			}
+		} else if trusted := net.ParseIP(proxy); trusted != nil && trusted.Equal(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Create an api token with the given name, returning the token. This is the only time the token itself is available
+func (s *Security) AddApiToken(name string) (string, error) {
+	b := make([]byte, 24)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	token := API_TOKEN_PREFIX + hex.EncodeToString(b)
+
+	s.ApiTokens = append(s.ApiTokens, ApiToken{
+		Id:        newId(),
+		Name:      name,
+		Hash:      hashApiToken(token),
+		CreatedAt: time.Now(),
+	})
+
+	return token, nil
+}
+
+// Remove the api token with the given id, returning whether it existed
+func (s *Security) RemoveApiToken(id string) bool {
+	for i := range s.ApiTokens {
+		if s.ApiTokens[i].Id == id {
+			s.ApiTokens = append(s.ApiTokens[:i], s.ApiTokens[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Find the api token matching the one given, or nil if it doesn't match any
+func (s *Security) CheckApiToken(token string) *ApiToken {
+	if !strings.HasPrefix(token, API_TOKEN_PREFIX) {
+		return nil
+	}
+
+	hash := hashApiToken(token)
+	for i := range s.ApiTokens {
+		if subtle.ConstantTimeCompare([]byte(s.ApiTokens[i].Hash), []byte(hash)) == 1 {
+			return &s.ApiTokens[i]
+		}
+	}
+
+	return nil
+}
+
+// The tokens are long and random, so a plain hash is enough to stop them being guessed from the config
+func hashApiToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const DEFAULT_PORT = 8000
+
+// Settings for how the web server is exposed.
+// Each of these can also be set with an env var, which takes precedence over the config file (see envOverrides)
+type Server struct {
+	// The url the app is reached at from a browser, e.g. https://syncer.example.com. Env: SYNCER_BASE_URL
+	BaseUrl string `json:"base_url"`
+	// The address to bind to. Empty binds to all interfaces. Env: SYNCER_LISTEN_ADDRESS
+	ListenAddress string `json:"listen_address"`
+	// Env: SYNCER_PORT
+	Port int `json:"port"`
+	// Serve over https if both of these are set. Env: SYNCER_TLS_CERT_FILE and SYNCER_TLS_KEY_FILE
+	TlsCertFile string `json:"tls_cert_file"`
+	TlsKeyFile  string `json:"tls_key_file"`
+}
+
+// Get the server settings, with the defaults applied
+func GetServer() (*Server, error) {
+	conf, err := LoadConfig(false)
+	if err != nil {
+		return nil, err
+	}
+	server := conf.Config.Server
+
+	if server.Port == 0 {
+		server.Port = DEFAULT_PORT
+	}
+	if server.BaseUrl == "" {
+		scheme := "http"
+		if server.UseTLS() {
+			scheme = "https"
+		}
+		server.BaseUrl = fmt.Sprintf("%s://localhost:%d", scheme, server.Port)
+	}
+	server.BaseUrl = strings.TrimSuffix(server.BaseUrl, "/")
+
+	return &server, nil
+}
+
+// The address for the server to listen on
+func (s *Server) Addr() string {
+	return net.JoinHostPort(s.ListenAddress, strconv.Itoa(s.Port))
+}
+
+func (s *Server) UseTLS() bool {
+	return s.TlsCertFile != "" && s.TlsKeyFile != ""
+}
+
+// Whether the app is reached over https, either directly or through a reverse proxy
+func (s *Server) IsSecure() bool {
+	return strings.HasPrefix(s.BaseUrl, "https://")
+}
+
+// The url spotify redirects back to after authorising. This needs to be added to the spotify app settings
+func (s *Server) SpotifyRedirectUri() string {
+	return s.BaseUrl + "/spotify-auth"
+}
+
+// The url lastfm redirects back to after authorising
+func (s *Server) LastFMCallbackUrl() string {
+	return s.BaseUrl + "/lastfm-auth"
+}
+
+// Check the server settings make sense together, returning a warning for anything that looks wrong.
+// None of these stop the app from starting, as a reverse proxy can legitimately cause most of them
+func (s *Server) Check() []string {
+	var warnings []string
+
+	if (s.TlsCertFile == "") != (s.TlsKeyFile == "") {
+		warnings = append(warnings, "Only one of the TLS cert and key files is set, so TLS is disabled")
+	}
+
+	baseUrl, err := url.Parse(s.BaseUrl)
+	if err != nil || (baseUrl.Scheme != "http" && baseUrl.Scheme != "https") || baseUrl.Host == "" {
+		return append(warnings, fmt.Sprintf("Base url %q is not a valid http(s) url; authorisation callbacks will not work", s.BaseUrl))
+	}
+	if baseUrl.Path != "" {
+		warnings = append(warnings, fmt.Sprintf("Base url %q has a path; callbacks will include it, but pages are still served from /", s.BaseUrl))
+	}
+
+	isLocal := baseUrl.Hostname() == "localhost" || baseUrl.Hostname() == "127.0.0.1" || baseUrl.Hostname() == "::1"
+	if !isLocal {
+		return warnings
+	}
+
+	// When the base url points at this machine, it should match how the server is actually listening
+	if s.UseTLS() && baseUrl.Scheme == "http" {
+		warnings = append(warnings, fmt.Sprintf("TLS is enabled but base url %q uses http", s.BaseUrl))
+	}
+	if !s.UseTLS() && baseUrl.Scheme == "https" {
+		warnings = append(warnings, fmt.Sprintf("Base url %q uses https but TLS is not enabled", s.BaseUrl))
+	}
+	basePort := baseUrl.Port()
+	if basePort == "" {
+		basePort = "80"
+		if baseUrl.Scheme == "https" {
+			basePort = "443"
+		}
+	}
+	if basePort != strconv.Itoa(s.Port) {
+		warnings = append(warnings, fmt.Sprintf("Base url %q uses port %s but the server listens on port %d", s.BaseUrl, basePort, s.Port))
+	}
+
+	return warnings
+}
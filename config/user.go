@@ -0,0 +1,128 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// The id of the user created for single user installs
+const DEFAULT_USER_ID = "default"
+
+// How many past sync runs are kept for each user
+const MAX_HISTORY = 50
+
+// Possible outcomes of a sync run
+const (
+	OUTCOME_SUCCESS         = "success"
+	OUTCOME_FAILED          = "failed"
+	OUTCOME_REAUTH_REQUIRED = "reauth_required"
+)
+
+// A person using the app, with their own lastfm and spotify accounts and sync settings
+type User struct {
+	Id      string          `json:"id"`
+	Name    string          `json:"name"`
+	LastFM  LastFMAuthData  `json:"last_fm"`
+	Spotify SpotifyAuthData `json:"spotify"`
+	Sync    SyncSettings    `json:"sync"`
+	History []SyncRun       `json:"history"`
+}
+
+// The record of a single sync run
+type SyncRun struct {
+	Period       string    `json:"period"`
+	StartedAt    time.Time `json:"started_at"`
+	FinishedAt   time.Time `json:"finished_at"`
+	Outcome      string    `json:"outcome"`
+	Error        string    `json:"error,omitempty"`
+	PlaylistId   string    `json:"playlist_id,omitempty"`
+	PlaylistName string    `json:"playlist_name,omitempty"`
+	Tracks       int       `json:"tracks"`
+	Matched      int       `json:"matched"`
+}
+
+// Get a user by id, or nil if there is no such user
+func (c *Config) GetUser(id string) *User {
+	for i := range c.Users {
+		if c.Users[i].Id == id {
+			return &c.Users[i]
+		}
+	}
+
+	return nil
+}
+
+// Add a new user with the given name, returning it
+func (c *Config) AddUser(name string) *User {
+	c.Users = append(c.Users, User{Id: newId(), Name: name})
+	return &c.Users[len(c.Users)-1]
+}
+
+// Remove the user with the given id, returning whether they existed
+func (c *Config) RemoveUser(id string) bool {
+	for i := range c.Users {
+		if c.Users[i].Id == id {
+			c.Users = append(c.Users[:i], c.Users[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Record a sync run in the user's history, dropping the oldest runs once the history is full
+func (u *User) AddHistory(run SyncRun) {
+	u.History = append(u.History, run)
+	if len(u.History) > MAX_HISTORY {
+		u.History = u.History[len(u.History)-MAX_HISTORY:]
+	}
+}
+
+// The sync periods the user has enabled
+func (u *User) EnabledPeriods() []string {
+	var periods []string
+	if u.Sync.Weekly.Enabled {
+		periods = append(periods, "weekly")
+	}
+	if u.Sync.Monthly.Enabled {
+		periods = append(periods, "monthly")
+	}
+	if u.Sync.Loved.Enabled {
+		periods = append(periods, "loved")
+	}
+	if u.Sync.Discovery.Enabled {
+		periods = append(periods, "discovery")
+	}
+	if u.Sync.Rediscovery.Enabled {
+		periods = append(periods, "rediscovery")
+	}
+	if u.Sync.Liked.Enabled {
+		periods = append(periods, "liked")
+	}
+	if u.Sync.Recent.Enabled {
+		periods = append(periods, "recent")
+	}
+
+	return periods
+}
+
+// Generate a random id for a user or blend
+func newId() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Fatal("Unable to generate id", "error", err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// Make sure there is always at least one user, so a fresh install works without setting up profiles first
+func ensureDefaultUser(conf *Config) {
+	if len(conf.Users) == 0 {
+		conf.Users = append(conf.Users, User{Id: DEFAULT_USER_ID, Name: "Default"})
+	}
+}
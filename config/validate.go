@@ -0,0 +1,150 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+)
+
+// The most tracks lastfm returns in a single page, which the top tracks for a playlist are fetched in
+const MAX_TRACKS = 1000
+
+// The most tracks spotify allows in a playlist
+const MAX_PLAYLIST_TRACKS = 10000
+
+// A problem with the config that will stop a sync working as expected
+type ValidationError struct {
+	// The user the problem is with, or empty if it affects everyone
+	UserId  string
+	Message string
+	// Whether a setting has a value that isn't allowed, rather than something still needing to be set up
+	Invalid bool
+}
+
+func (e ValidationError) Error() string {
+	return e.Message
+}
+
+// Check the config for settings that are out of range, or jobs that are enabled without the credentials they need
+func (c *Config) Validate() []ValidationError {
+	var problems []ValidationError
+	add := func(userId string, format string, args ...any) {
+		problems = append(problems, ValidationError{UserId: userId, Message: fmt.Sprintf(format, args...)})
+	}
+	invalid := func(userId string, format string, args ...any) {
+		problems = append(problems, ValidationError{UserId: userId, Message: fmt.Sprintf(format, args...), Invalid: true})
+	}
+
+	for _, user := range c.Users {
+		prefix := user.Name + ": "
+		addUser := func(format string, args ...any) {
+			add(user.Id, prefix+format, args...)
+		}
+		invalidUser := func(format string, args ...any) {
+			invalid(user.Id, prefix+format, args...)
+		}
+		checkMaxTracks := func(job string, maxTracks int, limit int) {
+			if maxTracks < 0 {
+				invalidUser("the %s max tracks can't be negative", job)
+			} else if maxTracks > limit {
+				invalidUser("the %s max tracks can't be more than %d", job, limit)
+			}
+		}
+		// Empty values are allowed for these, and mean the default
+		checkOneOf := func(setting string, value string, allowed ...string) {
+			if value != "" && !slices.Contains(allowed, value) {
+				invalidUser("the %s must be %s", setting, strings.Join(allowed, " or "))
+			}
+		}
+
+		for _, job := range []string{"weekly", "monthly"} {
+			period := user.Sync.Weekly
+			if job == "monthly" {
+				period = user.Sync.Monthly
+			}
+			checkMaxTracks(job, period.MaxTracks, MAX_TRACKS)
+			checkOneOf(job+" source", period.Source, SOURCE_TOP_TRACKS, SOURCE_TOP_ARTISTS)
+			checkOneOf(job+" artist tracks", period.ArtistTracks, ARTIST_TRACKS_LASTFM, ARTIST_TRACKS_SPOTIFY)
+			if period.ArtistCount < 0 || period.TracksPerArtist < 0 {
+				invalidUser("the %s artist and track counts can't be negative", job)
+			}
+			if period.MinTagWeight < 0 || period.MinTagWeight > 100 {
+				invalidUser("the %s minimum tag weight must be between 0 and 100", job)
+			}
+		}
+		checkMaxTracks("loved", user.Sync.Loved.MaxTracks, MAX_PLAYLIST_TRACKS)
+		checkMaxTracks("discovery", user.Sync.Discovery.MaxTracks, MAX_TRACKS)
+		checkOneOf("discovery seed period", user.Sync.Discovery.SeedPeriod, "weekly", "monthly")
+		if user.Sync.Discovery.SeedCount < 0 {
+			invalidUser("the discovery seed count can't be negative")
+		}
+		if user.Sync.Discovery.MinSimilarity < 0 || user.Sync.Discovery.MinSimilarity > 1 {
+			invalidUser("the discovery minimum similarity must be between 0 and 1")
+		}
+		checkMaxTracks("rediscovery", user.Sync.Rediscovery.MaxTracks, MAX_TRACKS)
+		if user.Sync.Rediscovery.Months < 0 || user.Sync.Rediscovery.MinPlaycount < 0 {
+			invalidUser("the rediscovery months and minimum playcount can't be negative")
+		}
+		checkOneOf("liked source", user.Sync.Liked.Source, LIKED_SOURCE_LIBRARY, LIKED_SOURCE_PLAYLIST)
+		if user.Sync.Liked.Enabled && user.Sync.Liked.Source == LIKED_SOURCE_PLAYLIST && user.Sync.Liked.PlaylistId == "" {
+			addUser("the liked sync needs a playlist to take tracks from")
+		}
+
+		// Every job reads from lastfm and uses spotify
+		if len(user.EnabledPeriods()) == 0 {
+			continue
+		}
+		if user.LastFM.Username == "" {
+			addUser("a lastfm username is needed for the enabled syncs")
+		}
+		if user.Spotify.RefreshToken == "" {
+			addUser("authorise with spotify for the enabled syncs to work")
+		}
+		// These write to lastfm, so need a session
+		if (user.Sync.Liked.Enabled || user.Sync.Recent.Enabled) && user.LastFM.Token == "" {
+			addUser("authorise with lastfm for the liked and recent syncs to work")
+		}
+	}
+
+	for _, blend := range c.Blends {
+		if !blend.Enabled {
+			continue
+		}
+		if blend.MaxTracks < 0 || blend.MaxTracks > MAX_TRACKS {
+			invalid(blend.OwnerId, "blend %s: max tracks must be between 0 and %d", blend.Name, MAX_TRACKS)
+		}
+		if len(blend.Usernames) < 2 {
+			add(blend.OwnerId, "blend %s: needs at least two lastfm usernames", blend.Name)
+		}
+		if c.GetUser(blend.OwnerId) == nil {
+			add("", "blend %s: the profile it belongs to no longer exists", blend.Name)
+		}
+	}
+
+	hasEnabledJobs := false
+	needsSession := false
+	for _, blend := range c.Blends {
+		hasEnabledJobs = hasEnabledJobs || blend.Enabled
+	}
+	for _, user := range c.Users {
+		hasEnabledJobs = hasEnabledJobs || len(user.EnabledPeriods()) > 0
+		needsSession = needsSession || user.Sync.Liked.Enabled || user.Sync.Recent.Enabled
+	}
+	if hasEnabledJobs && c.Auth.LastFM.ApiKey == "" {
+		add("", "a lastfm api key is needed for the enabled syncs")
+	}
+	if hasEnabledJobs && c.Auth.Spotify.ClientId == "" {
+		add("", "a spotify client id is needed for the enabled syncs")
+	}
+	if needsSession && c.Auth.LastFM.SharedSecret == "" {
+		add("", "a lastfm shared secret is needed for the liked and recent syncs")
+	}
+	for _, proxy := range c.Config.Security.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			add("", "trusted proxy %s isn't an ip or cidr range", proxy)
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,178 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// How often the config file and any secret files are checked for changes
+const WATCH_INTERVAL = 5 * time.Second
+
+// The size and modified time of the files the config is read from, as of the last load or write.
+// The config is reloaded when this changes
+var fileStamp string
+
+// Describe the state of the config file and any files the SYNCER_*_FILE env vars point at
+func configStamp() string {
+	paths := []string{Filename()}
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if strings.HasPrefix(name, ENV_PREFIX) && strings.HasSuffix(name, "_FILE") {
+			paths = append(paths, value)
+		}
+	}
+
+	var stamp strings.Builder
+	for _, path := range paths {
+		// Stat follows symlinks, so this also picks up kubernetes swapping the secret a mount points at
+		info, err := os.Stat(path)
+		if err != nil {
+			fmt.Fprintf(&stamp, "%s:missing;", path)
+			continue
+		}
+		fmt.Fprintf(&stamp, "%s:%d:%d;", path, info.Size(), info.ModTime().UnixNano())
+	}
+
+	return stamp.String()
+}
+
+// Watch the config file and secret files for changes made outside the app, e.g. by editing the file by hand.
+// When they change the config is reloaded, and onChange is called with the config from before and after the change.
+// If the changed config can't be loaded, the current config is kept
+func Watch(onChange func(before *Config, after *Config)) {
+	go func() {
+		for range time.Tick(WATCH_INTERVAL) {
+			before, after := reloadIfChanged()
+			if after != nil {
+				onChange(before, after)
+			}
+		}
+	}()
+}
+
+// Reload the config if its files have changed, returning copies of the before and after configs.
+// Returns nil if nothing changed or the reload failed
+func reloadIfChanged() (*Config, *Config) {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	if cachedData == nil || configStamp() == fileStamp {
+		return nil, nil
+	}
+	log.Info("Config file changed, reloading")
+	before := cachedData
+
+	// The secrets are read again too, as a mounted secret file may be what changed
+	savedEnvValues, savedFileValues := envValues, fileValues
+	savedKeysLoaded, savedCurrentKey, savedOldKeys := keysLoaded, currentKey, oldKeys
+	envValues, fileValues = nil, make(map[string]string)
+	keysLoaded, currentKey, oldKeys = false, nil, nil
+
+	after, err := loadLocked(true)
+	if err != nil {
+		log.Error("Unable to reload the config, keeping the current config", "error", err)
+		envValues, fileValues = savedEnvValues, savedFileValues
+		keysLoaded, currentKey, oldKeys = savedKeysLoaded, savedCurrentKey, savedOldKeys
+		// Don't try again until the file changes again
+		fileStamp = configStamp()
+		return nil, nil
+	}
+
+	changes := Diff(before, after)
+	if len(changes) == 0 {
+		log.Info("Config reloaded, nothing changed")
+	}
+	for _, change := range changes {
+		log.Info("Config changed", "setting", change)
+	}
+
+	return before.Clone(), after.Clone()
+}
+
+// List the settings that differ between two configs, e.g. users.default.sync.weekly.max_tracks.
+// Only the names of the settings are given, so secrets aren't exposed when logging them
+func Diff(before *Config, after *Config) []string {
+	var changes []string
+	diffJson("", toJson(before), toJson(after), &changes)
+	sort.Strings(changes)
+
+	return changes
+}
+
+// Convert a value to its generic JSON form
+func toJson(value any) any {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	var data any
+	json.Unmarshal(raw, &data)
+
+	return data
+}
+
+func diffJson(path string, before any, after any, changes *[]string) {
+	beforeObject, beforeIsObject := before.(map[string]any)
+	afterObject, afterIsObject := after.(map[string]any)
+	if beforeIsObject && afterIsObject {
+		keys := make(map[string]bool)
+		for key := range beforeObject {
+			keys[key] = true
+		}
+		for key := range afterObject {
+			keys[key] = true
+		}
+		for key := range keys {
+			diffJson(joinPath(path, key), beforeObject[key], afterObject[key], changes)
+		}
+		return
+	}
+
+	beforeList, beforeIsList := before.([]any)
+	afterList, afterIsList := after.([]any)
+	if beforeIsList && afterIsList {
+		beforeById, beforeHasIds := byId(beforeList)
+		afterById, afterHasIds := byId(afterList)
+		// Lists of users and blends are matched up by id, so removing one doesn't show everything after it as changed
+		if beforeHasIds && afterHasIds {
+			diffJson(path, beforeById, afterById, changes)
+			return
+		}
+	}
+
+	if !reflect.DeepEqual(before, after) {
+		*changes = append(*changes, path)
+	}
+}
+
+// Key a list of JSON objects by their id, if they all have one
+func byId(list []any) (map[string]any, bool) {
+	objects := make(map[string]any)
+	for _, item := range list {
+		object, ok := item.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		id, ok := object["id"].(string)
+		if !ok {
+			return nil, false
+		}
+		objects[id] = object
+	}
+
+	return objects, len(list) > 0
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,182 @@
+package cover
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	_ "image/png"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/charmbracelet/log"
+)
+
+// The width and height of generated covers
+const COVER_SIZE = 640
+
+// Spotify rejects covers whose base64 encoded JPEG is larger than this
+const MAX_COVER_BYTES = 256 * 1024
+
+// Lastfm returns this image when it has no art for an album, which isn't worth putting on a cover
+const LASTFM_PLACEHOLDER_IMAGE = "2a96cbd8b46e442fc41c2b86b821562f"
+
+// The background and text colours of title cards
+var (
+	backgroundColour = color.RGBA{R: 0xd5, G: 0x10, B: 0x07, A: 0xff}
+	textColour       = color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+)
+
+// Generate a JPEG cover for a playlist.
+// If there is enough album art, the cover is a grid of the first albums, otherwise it is a title card with the given lines of text
+func Generate(imageUrls []string, lines []string) ([]byte, error) {
+	images := fetchImages(uniqueImageUrls(imageUrls), 9)
+
+	var cover *image.RGBA
+	switch {
+	case len(images) >= 9:
+		cover = drawGrid(images[:9], 3)
+	case len(images) >= 4:
+		cover = drawGrid(images[:4], 2)
+	default:
+		cover = drawTitleCard(lines)
+	}
+
+	return encode(cover)
+}
+
+// Drop empty urls, lastfm's placeholder image and repeats of the same album
+func uniqueImageUrls(imageUrls []string) []string {
+	seen := make(map[string]bool)
+	var urls []string
+	for _, v := range imageUrls {
+		if v == "" || strings.Contains(v, LASTFM_PLACEHOLDER_IMAGE) || seen[v] {
+			continue
+		}
+		seen[v] = true
+		urls = append(urls, v)
+	}
+
+	return urls
+}
+
+// Download up to limit images, skipping any that can't be fetched or decoded
+func fetchImages(imageUrls []string, limit int) []image.Image {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	var images []image.Image
+	for _, v := range imageUrls {
+		if len(images) >= limit {
+			break
+		}
+
+		resp, err := client.Get(v)
+		if err != nil {
+			log.Warn("Unable to fetch album art", "url", v, "error", err)
+			continue
+		}
+		img, _, err := image.Decode(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			log.Warn("Unable to decode album art", "url", v, "error", err)
+			continue
+		}
+		images = append(images, img)
+	}
+
+	return images
+}
+
+// Draw the images in a square grid with the given number of columns
+func drawGrid(images []image.Image, columns int) *image.RGBA {
+	cover := image.NewRGBA(image.Rect(0, 0, COVER_SIZE, COVER_SIZE))
+	cellSize := COVER_SIZE / columns
+
+	for i, img := range images {
+		x := (i % columns) * cellSize
+		y := (i / columns) * cellSize
+		drawScaled(cover, image.Rect(x, y, x+cellSize, y+cellSize), img)
+	}
+
+	return cover
+}
+
+// Draw an image scaled to fill the rectangle, using nearest neighbour scaling
+func drawScaled(dst *image.RGBA, rect image.Rectangle, src image.Image) {
+	bounds := src.Bounds()
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		srcY := bounds.Min.Y + (y-rect.Min.Y)*bounds.Dy()/rect.Dy()
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			srcX := bounds.Min.X + (x-rect.Min.X)*bounds.Dx()/rect.Dx()
+			dst.Set(x, y, src.At(srcX, srcY))
+		}
+	}
+}
+
+// Draw the lines of text centred on a plain background.
+// Each line is scaled to fit the width of the cover, up to a maximum size
+func drawTitleCard(lines []string) *image.RGBA {
+	cover := image.NewRGBA(image.Rect(0, 0, COVER_SIZE, COVER_SIZE))
+	draw.Draw(cover, cover.Bounds(), &image.Uniform{C: backgroundColour}, image.Point{}, draw.Src)
+
+	margin := COVER_SIZE / 10
+	scales := make([]int, len(lines))
+	totalHeight := 0
+	for i, line := range lines {
+		width := len([]rune(line))*(GLYPH_WIDTH+1) - 1
+		scales[i] = min(12, (COVER_SIZE-2*margin)/max(width, 1))
+		scales[i] = max(scales[i], 1)
+		totalHeight += GLYPH_HEIGHT * scales[i] * 3 / 2
+	}
+
+	y := (COVER_SIZE - totalHeight) / 2
+	for i, line := range lines {
+		width := (len([]rune(line))*(GLYPH_WIDTH+1) - 1) * scales[i]
+		drawText(cover, line, (COVER_SIZE-width)/2, y, scales[i])
+		y += GLYPH_HEIGHT * scales[i] * 3 / 2
+	}
+
+	return cover
+}
+
+// Draw text with its top left corner at x, y, with each font pixel drawn as a scale sized square
+func drawText(dst *image.RGBA, text string, x int, y int, scale int) {
+	for _, char := range text {
+		glyph, ok := glyphs[unicode.ToUpper(char)]
+		if ok {
+			for row, bits := range glyph {
+				for col, bit := range bits {
+					if bit != '1' {
+						continue
+					}
+					px := x + col*scale
+					py := y + row*scale
+					draw.Draw(dst, image.Rect(px, py, px+scale, py+scale), &image.Uniform{C: textColour}, image.Point{}, draw.Src)
+				}
+			}
+		}
+		x += (GLYPH_WIDTH + 1) * scale
+	}
+}
+
+// Encode the cover as a JPEG small enough for spotify, lowering the quality until it fits
+func encode(cover image.Image) ([]byte, error) {
+	for quality := 90; quality >= 30; quality -= 10 {
+		var buf bytes.Buffer
+		err := jpeg.Encode(&buf, cover, &jpeg.Options{Quality: quality})
+		if err != nil {
+			log.Error("Error encoding cover", "error", err)
+			return nil, err
+		}
+		if base64.StdEncoding.EncodedLen(buf.Len()) <= MAX_COVER_BYTES {
+			return buf.Bytes(), nil
+		}
+	}
+
+	return nil, errors.New("cover is too large for spotify")
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"example/lastfm-spotify-syncer/config"
+	"net/http"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/gin-gonic/gin"
+)
+
+// How many characters at the end of a saved secret are shown, so it can be told apart from others
+const SECRET_HINT_LENGTH = 4
+
+// A field in the credentials form.
+// Secrets are never sent back to the browser; the form only shows whether one is saved and how it ends
+type credentialField struct {
+	// The form field name, which is also the field's id for env overrides
+	Id    string
+	Title string
+	// The current value. Always empty for secrets
+	Value    string
+	Secret   bool
+	Optional bool
+	// Whether a secret has been saved
+	IsSet bool
+	// The end of the saved secret, e.g. ••••1a2b
+	Hint string
+	// The env var setting the field, which locks it in the form
+	Env string
+}
+
+// Whether the field must be filled in before the form can be saved
+func (f credentialField) Required() bool {
+	return !f.Optional && f.Env == "" && !(f.Secret && f.IsSet)
+}
+
+func plainField(id string, title string, value string) credentialField {
+	return credentialField{
+		Id:    id,
+		Title: title,
+		Value: value,
+		Env:   config.EnvOverride(id),
+	}
+}
+
+func secretField(id string, title string, value string, optional bool) credentialField {
+	field := credentialField{
+		Id:       id,
+		Title:    title,
+		Secret:   true,
+		Optional: optional,
+		IsSet:    value != "",
+		Env:      config.EnvOverride(id),
+	}
+	// Short secrets would give too much away
+	if len(value) >= SECRET_HINT_LENGTH*3 {
+		field.Hint = "••••" + value[len(value)-SECRET_HINT_LENGTH:]
+	}
+
+	return field
+}
+
+// The fields of the credentials form for the given user
+func credentialFields(conf *config.Config, user *config.User) []credentialField {
+	return []credentialField{
+		plainField("lastfm-api-key", "LastFM Api Key", conf.Auth.LastFM.ApiKey),
+		secretField("lastfm-shared-secret", "LastFM Shared Secret", conf.Auth.LastFM.SharedSecret, false),
+		{
+			Id:    "lastfm-username",
+			Title: "LastFM username",
+			Value: user.LastFM.Username,
+		},
+		plainField("spotify-client-id", "Spotify Client Id", conf.Auth.Spotify.ClientId),
+		secretField("spotify-client-secret", "Spotify Client Secret (optional)", conf.Auth.Spotify.ClientSecret, true),
+	}
+}
+
+// Save the app credentials and the current user's lastfm username.
+// Secrets left blank keep their saved value, unless the box to remove them is ticked
+func saveCredentials(c *gin.Context) {
+	conf, err := config.LoadConfig(true)
+	if err != nil {
+		log.Error("Error reading config", "error", err)
+		c.String(http.StatusInternalServerError, "Error reading config file")
+		return
+	}
+
+	type Credentials struct {
+		LastFMApiKey             string `form:"lastfm-api-key"`
+		LastFmSharedSecret       string `form:"lastfm-shared-secret"`
+		LastFmUsername           string `form:"lastfm-username"`
+		SpotifyClientId          string `form:"spotify-client-id"`
+		SpotifyClientSecret      string `form:"spotify-client-secret"`
+		ClearSpotifyClientSecret bool   `form:"spotify-client-secret-clear"`
+	}
+	var credentials Credentials
+	err = c.Bind(&credentials)
+	if err != nil {
+		log.Error("Error reading form data", "error", err)
+		c.String(http.StatusInternalServerError, "Error reading form data")
+		return
+	}
+
+	userId := getCurrentUser(c, conf).Id
+	err = config.Update(func(conf *config.Config) error {
+		conf.Auth.LastFM.ApiKey = strings.TrimSpace(credentials.LastFMApiKey)
+		if secret := strings.TrimSpace(credentials.LastFmSharedSecret); secret != "" {
+			conf.Auth.LastFM.SharedSecret = secret
+		}
+		conf.Auth.Spotify.ClientId = strings.TrimSpace(credentials.SpotifyClientId)
+		if secret := strings.TrimSpace(credentials.SpotifyClientSecret); secret != "" {
+			conf.Auth.Spotify.ClientSecret = secret
+		} else if credentials.ClearSpotifyClientSecret {
+			conf.Auth.Spotify.ClientSecret = ""
+		}
+		user := conf.GetUser(userId)
+		if user == nil {
+			return errNotFound
+		}
+		user.LastFM.Username = strings.TrimSpace(credentials.LastFmUsername)
+		return nil
+	})
+	if err != nil {
+		respondUpdateError(c, err, "No such user")
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"example/lastfm-spotify-syncer/config"
+	"example/lastfm-spotify-syncer/importer"
+	"example/lastfm-spotify-syncer/sync"
+	"net/http"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/gin-gonic/gin"
+)
+
+// How many of the pending plays to list on the import report
+const IMPORT_REPORT_PLAYS = 100
+
+// Show the page for importing spotify plays into lastfm
+func getImport(c *gin.Context) {
+	conf, err := config.LoadConfig(false)
+	if err != nil {
+		log.Error("Error reading config", "error", err)
+		c.String(http.StatusInternalServerError, "Error reading config file")
+		return
+	}
+
+	c.HTML(http.StatusOK, "import", gin.H{
+		"currentUser": getCurrentUser(c, conf),
+		"csrfToken":   csrfToken(c),
+	})
+}
+
+// Import plays from uploaded streaming history files, or from spotify's recently played tracks.
+// Unless dry run is turned off, this only reports what would be scrobbled
+func postImport(c *gin.Context) {
+	type ImportParams struct {
+		Source string `form:"source"`
+		DryRun bool   `form:"dry-run"`
+	}
+	var params ImportParams
+	if err := c.ShouldBind(&params); err != nil {
+		log.Error("error reading input", "error", err)
+		c.String(http.StatusBadRequest, "Error reading import parameters")
+		return
+	}
+
+	conf, err := config.LoadConfig(false)
+	if err != nil {
+		log.Error("Error reading config", "error", err)
+		c.String(http.StatusInternalServerError, "Error reading config file")
+		return
+	}
+	user := getCurrentUser(c, conf)
+	if user.LastFM.Username == "" || user.LastFM.Token == "" {
+		c.String(http.StatusBadRequest, "Authorise with lastFM before importing plays")
+		return
+	}
+
+	var plays []importer.Play
+	switch params.Source {
+	case "recent":
+		plays, err = importer.GetRecentlyPlayed(user.Id, time.Now().Add(-importer.MAX_SCROBBLE_AGE))
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Error fetching recently played tracks from spotify")
+			return
+		}
+	default:
+		form, err := c.MultipartForm()
+		if err != nil || len(form.File["history"]) == 0 {
+			c.String(http.StatusBadRequest, "Choose at least one streaming history file to import")
+			return
+		}
+		for _, fileHeader := range form.File["history"] {
+			file, err := fileHeader.Open()
+			if err != nil {
+				log.Error("Error opening uploaded file", "file", fileHeader.Filename, "error", err)
+				c.String(http.StatusBadRequest, "Unable to read "+fileHeader.Filename)
+				return
+			}
+			filePlays, err := importer.ReadStreamingHistory(file)
+			file.Close()
+			if err != nil {
+				c.String(http.StatusBadRequest, fileHeader.Filename+" is not a spotify streaming history file")
+				return
+			}
+			plays = append(plays, filePlays...)
+		}
+	}
+
+	report, err := importer.Plan(user.LastFM.Username, plays)
+	if err != nil {
+		log.Error("Error checking plays against lastfm", "error", err)
+		c.String(http.StatusInternalServerError, "Error checking plays against lastFM")
+		return
+	}
+
+	data := gin.H{
+		"currentUser": user,
+		"report":      report,
+		"dryRun":      params.DryRun,
+		"plays":       report.Pending[:min(len(report.Pending), IMPORT_REPORT_PLAYS)],
+		"csrfToken":   csrfToken(c),
+	}
+	if !params.DryRun && len(report.Pending) > 0 {
+		accepted, ignored, err := importer.Submit(user.LastFM.Token, report)
+		if err != nil {
+			if sync.FlagReauthRequired(user.Id, err) {
+				c.String(http.StatusUnauthorized, "Re-authorization required")
+				return
+			}
+			c.String(http.StatusInternalServerError, "Error scrobbling plays")
+			return
+		}
+		data["accepted"] = accepted
+		data["ignored"] = ignored
+	}
+
+	c.HTML(http.StatusOK, "import", data)
+}
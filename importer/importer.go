@@ -0,0 +1,263 @@
+package importer
+
+import (
+	"encoding/json"
+	lastFmApi "example/lastfm-spotify-syncer/lastfm/api"
+	spotifyApi "example/lastfm-spotify-syncer/spotify/api"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Lastfm only counts plays of at least 30 seconds
+const MIN_PLAY_DURATION = 30 * time.Second
+
+// Lastfm ignores scrobbles with a timestamp older than this
+const MAX_SCROBBLE_AGE = 14 * 24 * time.Hour
+
+// Plays of the same track within this long of an existing scrobble are treated as already scrobbled.
+// Scrobblers don't agree on whether a scrobble is timestamped at the start or end of a play, so this needs some slack
+const DUPLICATE_WINDOW = 10 * time.Minute
+
+// The most tracks lastfm will return per page of recent tracks
+const RECENT_TRACKS_PAGE_SIZE = 200
+
+// A play of a track on spotify
+type Play struct {
+	Artist string
+	Track  string
+	Album  string
+	// When the track started playing
+	StartedAt time.Time
+	Duration  time.Duration
+}
+
+// What an import will do, so it can be checked before anything is scrobbled
+type Report struct {
+	Total            int
+	TooShort         int
+	TooOld           int
+	Duplicates       int
+	AlreadyScrobbled int
+	// The plays that will be scrobbled, oldest first
+	Pending []Play
+}
+
+// An entry in spotify's extended streaming history export
+type streamingHistoryEntry struct {
+	// When the play ended
+	Ts         string `json:"ts"`
+	MsPlayed   int    `json:"ms_played"`
+	TrackName  string `json:"master_metadata_track_name"`
+	ArtistName string `json:"master_metadata_album_artist_name"`
+	AlbumName  string `json:"master_metadata_album_album_name"`
+	TrackUri   string `json:"spotify_track_uri"`
+}
+
+// Read the plays from one of the Streaming_History_Audio_*.json files in spotify's extended streaming history export.
+// Podcast episodes and anything else without a track are skipped
+func ReadStreamingHistory(r io.Reader) ([]Play, error) {
+	var entries []streamingHistoryEntry
+	err := json.NewDecoder(r).Decode(&entries)
+	if err != nil {
+		log.Error("Error decoding streaming history", "error", err)
+		return nil, err
+	}
+
+	var plays []Play
+	for _, v := range entries {
+		if v.TrackName == "" || v.ArtistName == "" {
+			continue
+		}
+		endedAt, err := time.Parse(time.RFC3339, v.Ts)
+		if err != nil {
+			log.Warn("Skipping play with an invalid timestamp", "ts", v.Ts, "track", v.TrackName)
+			continue
+		}
+
+		duration := time.Duration(v.MsPlayed) * time.Millisecond
+		plays = append(plays, Play{
+			Artist:    v.ArtistName,
+			Track:     v.TrackName,
+			Album:     v.AlbumName,
+			StartedAt: endedAt.Add(-duration),
+			Duration:  duration,
+		})
+	}
+
+	return plays, nil
+}
+
+// Get the plays from spotify's recently played tracks since the given time
+func GetRecentlyPlayed(userId string, since time.Time) ([]Play, error) {
+	recentlyPlayed, err := spotifyApi.GetRecentlyPlayed(userId, since)
+	if err != nil {
+		log.Error("Unable to fetch recently played tracks from spotify api", "error", err)
+		return nil, err
+	}
+
+	var plays []Play
+	for _, v := range recentlyPlayed.Items {
+		if len(v.Track.Artists) == 0 {
+			continue
+		}
+		playedAt, err := time.Parse(time.RFC3339, v.PlayedAt)
+		if err != nil {
+			log.Warn("Skipping play with an invalid timestamp", "played_at", v.PlayedAt, "track", v.Track.Name)
+			continue
+		}
+
+		// Spotify records when the play finished, and doesn't say how much of the track was played
+		duration := time.Duration(v.Track.DurationMs) * time.Millisecond
+		plays = append(plays, Play{
+			Artist:    v.Track.Artists[0].Name,
+			Track:     v.Track.Name,
+			Album:     v.Track.Album.Name,
+			StartedAt: playedAt.Add(-duration),
+			Duration:  duration,
+		})
+	}
+
+	return plays, nil
+}
+
+// Work out which of the plays are missing from the user's lastfm history.
+// Nothing is scrobbled; the report is passed to Submit once it has been checked
+func Plan(username string, plays []Play) (*Report, error) {
+	report, candidates := filterPlays(plays, time.Now())
+	if len(candidates) == 0 {
+		return report, nil
+	}
+
+	scrobbled, err := getScrobbles(username, candidates[0].StartedAt.Add(-DUPLICATE_WINDOW), candidates[len(candidates)-1].StartedAt.Add(DUPLICATE_WINDOW))
+	if err != nil {
+		return nil, err
+	}
+	skipScrobbled(report, candidates, scrobbled)
+
+	return report, nil
+}
+
+// Sort the plays oldest first, and drop anything lastfm won't accept as of now, and plays that appear more than once,
+// e.g. in overlapping export files. Returns the report so far and the plays left
+func filterPlays(plays []Play, now time.Time) (*Report, []Play) {
+	report := Report{Total: len(plays)}
+	oldest := now.Add(-MAX_SCROBBLE_AGE)
+
+	sort.SliceStable(plays, func(i, j int) bool {
+		return plays[i].StartedAt.Before(plays[j].StartedAt)
+	})
+
+	var candidates []Play
+	seen := make(map[string]bool)
+	for _, v := range plays {
+		if v.Duration > 0 && v.Duration < MIN_PLAY_DURATION {
+			report.TooShort++
+			continue
+		}
+		if v.StartedAt.Before(oldest) {
+			report.TooOld++
+			continue
+		}
+		key := playKey(v.Artist, v.Track) + "\x00" + strconv.FormatInt(v.StartedAt.Unix(), 10)
+		if seen[key] {
+			report.Duplicates++
+			continue
+		}
+		seen[key] = true
+		candidates = append(candidates, v)
+	}
+
+	return &report, candidates
+}
+
+// Add the plays without a matching scrobble to the report's pending plays. Matched scrobbles are used up
+func skipScrobbled(report *Report, plays []Play, scrobbled map[string][]time.Time) {
+	for _, v := range plays {
+		key := playKey(v.Artist, v.Track)
+		if i := findScrobble(scrobbled[key], v.StartedAt); i >= 0 {
+			// Each scrobble can only account for one play, so repeats of a short track aren't all skipped
+			scrobbled[key] = append(scrobbled[key][:i], scrobbled[key][i+1:]...)
+			report.AlreadyScrobbled++
+			continue
+		}
+		report.Pending = append(report.Pending, v)
+	}
+}
+
+// Scrobble the pending plays in a report, returning how many lastfm accepted and ignored
+func Submit(sessionKey string, report *Report) (int, int, error) {
+	scrobbles := make([]lastFmApi.Scrobble, 0, len(report.Pending))
+	for _, v := range report.Pending {
+		scrobbles = append(scrobbles, lastFmApi.Scrobble{
+			Artist:    v.Artist,
+			Track:     v.Track,
+			Album:     v.Album,
+			Timestamp: v.StartedAt,
+			Duration:  int(v.Duration.Seconds()),
+		})
+	}
+
+	accepted, ignored, err := lastFmApi.ScrobbleTracks(sessionKey, scrobbles)
+	if err != nil {
+		log.Error("Error scrobbling plays", "error", err)
+		return accepted, ignored, err
+	}
+	log.Info("Imported plays", "accepted", accepted, "ignored", ignored)
+
+	return accepted, ignored, nil
+}
+
+// Get the times of the user's scrobbles between the given times, keyed by playKey
+func getScrobbles(username string, from time.Time, to time.Time) (map[string][]time.Time, error) {
+	scrobbled := make(map[string][]time.Time)
+
+	for page := 1; ; page++ {
+		recentTracksData, err := lastFmApi.GetRecentTracksPage(from, to, RECENT_TRACKS_PAGE_SIZE, page, username)
+		if err != nil {
+			log.Error("Unable to fetch recent tracks from last fm api", "error", err)
+			return nil, err
+		}
+
+		for _, v := range recentTracksData.Recenttracks.Track {
+			// The track currently playing has no date, and hasn't been scrobbled yet
+			uts, err := strconv.ParseInt(v.Date.Uts, 10, 64)
+			if err != nil {
+				continue
+			}
+			key := playKey(v.Artist.Text, v.Name)
+			scrobbled[key] = append(scrobbled[key], time.Unix(uts, 0))
+		}
+
+		totalPages, err := strconv.Atoi(recentTracksData.Recenttracks.Attr.TotalPages)
+		if err != nil || page >= totalPages || len(recentTracksData.Recenttracks.Track) == 0 {
+			break
+		}
+	}
+
+	return scrobbled, nil
+}
+
+// Find a scrobble close enough to the play to be the same play, returning its index or -1 if there isn't one
+func findScrobble(times []time.Time, startedAt time.Time) int {
+	for i, t := range times {
+		diff := t.Sub(startedAt)
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff <= DUPLICATE_WINDOW {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// A key to compare plays by, ignoring case
+func playKey(artist string, track string) string {
+	return strings.ToLower(artist) + "\x00" + strings.ToLower(track)
+}
@@ -0,0 +1,186 @@
+package importer
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var now = time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+
+func play(artist string, track string, startedAt time.Time, duration time.Duration) Play {
+	return Play{Artist: artist, Track: track, StartedAt: startedAt, Duration: duration}
+}
+
+func describe(plays []Play) string {
+	var items []string
+	for _, v := range plays {
+		items = append(items, v.Track+"@"+v.StartedAt.Format("01-02 15:04"))
+	}
+
+	return strings.Join(items, ", ")
+}
+
+func TestFilterPlays(t *testing.T) {
+	hourAgo := now.Add(-time.Hour)
+
+	tests := []struct {
+		name  string
+		plays []Play
+		want  Report
+		left  string
+	}{
+		{
+			name: "drops plays repeated across overlapping export files",
+			plays: []Play{
+				// The first file
+				play("Cher", "Believe", hourAgo, 3*time.Minute),
+				play("Cher", "Strong Enough", hourAgo.Add(4*time.Minute), 3*time.Minute),
+				// The second file, starting part way through the first
+				play("Cher", "Strong Enough", hourAgo.Add(4*time.Minute), 3*time.Minute),
+				play("Cher", "Dov'è l'amore", hourAgo.Add(8*time.Minute), 3*time.Minute),
+			},
+			want: Report{Total: 4, Duplicates: 1},
+			left: "Believe@06-15 11:00, Strong Enough@06-15 11:04, Dov'è l'amore@06-15 11:08",
+		},
+		{
+			name: "compares tracks ignoring case",
+			plays: []Play{
+				play("Cher", "Believe", hourAgo, 3*time.Minute),
+				play("CHER", "believe", hourAgo, 3*time.Minute),
+			},
+			want: Report{Total: 2, Duplicates: 1},
+			left: "Believe@06-15 11:00",
+		},
+		{
+			name: "keeps repeats of the same track at different times",
+			plays: []Play{
+				play("Cher", "Believe", hourAgo.Add(time.Minute), 40*time.Second),
+				play("Cher", "Believe", hourAgo, 40*time.Second),
+			},
+			want: Report{Total: 2},
+			left: "Believe@06-15 11:00, Believe@06-15 11:01",
+		},
+		{
+			name: "drops plays shorter than lastfm counts",
+			plays: []Play{
+				play("Cher", "Believe", hourAgo, MIN_PLAY_DURATION-time.Second),
+				play("Cher", "Strong Enough", hourAgo, MIN_PLAY_DURATION),
+				// Recently played tracks without a duration are kept
+				play("Cher", "Dov'è l'amore", hourAgo, 0),
+			},
+			want: Report{Total: 3, TooShort: 1},
+			left: "Strong Enough@06-15 11:00, Dov'è l'amore@06-15 11:00",
+		},
+		{
+			name: "drops plays too old for lastfm to accept",
+			plays: []Play{
+				play("Cher", "Believe", now.Add(-MAX_SCROBBLE_AGE-time.Second), 3*time.Minute),
+				play("Cher", "Strong Enough", now.Add(-MAX_SCROBBLE_AGE), 3*time.Minute),
+			},
+			want: Report{Total: 2, TooOld: 1},
+			left: "Strong Enough@06-01 12:00",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, candidates := filterPlays(tt.plays, now)
+
+			if report.Total != tt.want.Total || report.TooShort != tt.want.TooShort || report.TooOld != tt.want.TooOld || report.Duplicates != tt.want.Duplicates {
+				t.Errorf("report = %+v, want %+v", *report, tt.want)
+			}
+			if got := describe(candidates); got != tt.left {
+				t.Errorf("plays left = %q, want %q", got, tt.left)
+			}
+		})
+	}
+}
+
+func TestSkipScrobbled(t *testing.T) {
+	start := now.Add(-time.Hour)
+
+	tests := []struct {
+		name      string
+		plays     []Play
+		scrobbled map[string][]time.Time
+		skipped   int
+		pending   string
+	}{
+		{
+			name: "skips plays already scrobbled",
+			plays: []Play{
+				play("Cher", "Believe", start, 3*time.Minute),
+				play("Cher", "Strong Enough", start.Add(4*time.Minute), 3*time.Minute),
+			},
+			scrobbled: map[string][]time.Time{
+				playKey("cher", "believe"): {start.Add(3 * time.Minute)},
+			},
+			skipped: 1,
+			pending: "Strong Enough@06-15 11:04",
+		},
+		{
+			name: "each scrobble only accounts for one repeat of a short track",
+			plays: []Play{
+				play("Cher", "Believe", start, 40*time.Second),
+				play("Cher", "Believe", start.Add(time.Minute), 40*time.Second),
+				play("Cher", "Believe", start.Add(2*time.Minute), 40*time.Second),
+			},
+			scrobbled: map[string][]time.Time{
+				playKey("Cher", "Believe"): {start.Add(40 * time.Second), start.Add(100 * time.Second)},
+			},
+			skipped: 2,
+			pending: "Believe@06-15 11:02",
+		},
+		{
+			name: "scrobbles of other tracks don't count",
+			plays: []Play{
+				play("Cher", "Believe", start, 3*time.Minute),
+			},
+			scrobbled: map[string][]time.Time{
+				playKey("Cher", "Strong Enough"): {start},
+			},
+			pending: "Believe@06-15 11:00",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := &Report{}
+			skipScrobbled(report, tt.plays, tt.scrobbled)
+
+			if report.AlreadyScrobbled != tt.skipped {
+				t.Errorf("already scrobbled = %d, want %d", report.AlreadyScrobbled, tt.skipped)
+			}
+			if got := describe(report.Pending); got != tt.pending {
+				t.Errorf("pending = %q, want %q", got, tt.pending)
+			}
+		})
+	}
+}
+
+func TestFindScrobble(t *testing.T) {
+	startedAt := now
+
+	tests := []struct {
+		name  string
+		times []time.Time
+		want  int
+	}{
+		{"no scrobbles", nil, -1},
+		{"scrobbled at the start", []time.Time{startedAt}, 0},
+		{"at the end of the window", []time.Time{startedAt.Add(DUPLICATE_WINDOW)}, 0},
+		{"at the start of the window", []time.Time{startedAt.Add(-DUPLICATE_WINDOW)}, 0},
+		{"just after the window", []time.Time{startedAt.Add(DUPLICATE_WINDOW + time.Second)}, -1},
+		{"just before the window", []time.Time{startedAt.Add(-DUPLICATE_WINDOW - time.Second)}, -1},
+		{"first within the window", []time.Time{startedAt.Add(-time.Hour), startedAt.Add(time.Minute), startedAt}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := findScrobble(tt.times, startedAt); got != tt.want {
+				t.Errorf("findScrobble() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
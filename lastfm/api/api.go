@@ -6,12 +6,15 @@ import (
 	"encoding/json"
 	"errors"
 	"example/lastfm-spotify-syncer/config"
+	"example/lastfm-spotify-syncer/metrics"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/charmbracelet/log"
 )
@@ -29,6 +32,14 @@ type AuthData struct {
 // Hit the lastfm api to authorize the user
 // This will handle the hashing signature requirement
 func Authorize(authData *AuthData, token string) error {
+	// Getting a session is signed, but isn't made on behalf of a user so has no session key yet
+	return GetSigned(authData, "", map[string]string{
+		"method": "auth.getSession",
+		"token":  token,
+	})
+}
+
+func Get[T any](data *T, params map[string]string) error {
 	conf, err := config.LoadConfig(false)
 	if err != nil {
 		log.Error("Error reading config file", "error", err)
@@ -39,17 +50,13 @@ func Authorize(authData *AuthData, token string) error {
 	// Create a map of query parameters
 	queryParams := url.Values{}
 	queryParams.Add("api_key", lastFmApiKey)
-	queryParams.Add("token", token)
-	queryParams.Add("method", "auth.getSession")
 
-	sortedParamString := getSortedMapKV(queryParams)
-	fullSigString := sortedParamString + conf.Auth.LastFM.SharedSecret
-	hashedSignature := encodeLastFmCall(fullSigString)
-	log.Info("hashed signature", "sig", hashedSignature)
+	for key, value := range params {
+		queryParams.Add(key, value)
+	}
 
 	// Add format afterwards for some unknown reason...
 	queryParams.Add("format", "json")
-	queryParams.Add("api_sig", hashedSignature)
 
 	// Encode the query parameters into a URL-encoded string
 	query := queryParams.Encode()
@@ -68,9 +75,11 @@ func Authorize(authData *AuthData, token string) error {
 
 	// Make the HTTP request
 	client := &http.Client{}
+	startedAt := time.Now()
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Error("Error making the request:", "error", err)
+		metrics.ObserveLastFmRequest(params["method"], metrics.STATUS_ERROR, time.Since(startedAt))
+		log.Error("Error making the request:", err)
 		return err
 	}
 	defer resp.Body.Close()
@@ -80,71 +89,139 @@ func Authorize(authData *AuthData, token string) error {
 		log.Warn("failed", "error code", resp.StatusCode)
 	}
 
-	// Decode the JSON response into the map
-	return json.NewDecoder(resp.Body).Decode(&authData)
-}
-
-func Get[T any](data *T, params map[string]string) error {
-	conf, err := config.LoadConfig(false)
+	respData, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Error("Error reading config file", "error", err)
+		metrics.ObserveLastFmRequest(params["method"], metrics.STATUS_ERROR, time.Since(startedAt))
+		log.Error("Error reading response", "error", err)
 		return err
 	}
-	lastFmApiKey := conf.Auth.LastFM.ApiKey
 
-	// Create a map of query parameters
-	queryParams := url.Values{}
-	queryParams.Add("api_key", lastFmApiKey)
+	// Lastfm reports errors in the response body, so check for one before decoding
+	var apiErr Error
+	json.Unmarshal(respData, &apiErr)
+	observeRequest(params["method"], startedAt, resp.StatusCode, apiErr.Code)
+	if apiErr.Code != 0 {
+		log.Warn("lastfm returned an error", "code", apiErr.Code, "message", apiErr.Message)
+		return &apiErr
+	}
 
-	for key, value := range params {
-		queryParams.Add(key, value)
+	return json.Unmarshal(respData, &data)
+}
+
+// Record a request to lastfm for metrics. An error lastfm returned in the body is reported in place of the http status
+func observeRequest(method string, startedAt time.Time, statusCode int, errorCode int) {
+	status := metrics.Status(statusCode)
+	if errorCode != 0 {
+		status = "lastfm_" + strconv.Itoa(errorCode)
 	}
+	metrics.ObserveLastFmRequest(method, status, time.Since(startedAt))
+}
 
-	// Add format afterwards for some unknown reason...
-	queryParams.Add("format", "json")
+// Params that are sent to lastfm but aren't part of the signature
+var unsignedParams = map[string]bool{
+	"format":   true,
+	"callback": true,
+}
 
-	// Encode the query parameters into a URL-encoded string
-	query := queryParams.Encode()
+// Send a signed GET request to the lastfm api on behalf of the user with the given session key.
+// The session key can be empty for methods that are signed but don't act for a user, e.g. auth.getSession
+func GetSigned[T any](data *T, sessionKey string, params map[string]string) error {
+	return signedRequest(data, "GET", sessionKey, params)
+}
 
-	// Build the complete URL with query parameters
-	fullURL := fmt.Sprintf("%s?%s", LASTFM_API_URL, query)
-	log.Info("full URL", "url", fullURL)
+// Send a signed POST request to the lastfm api on behalf of the user with the given session key.
+// This is needed for any method that changes the user's data, e.g. loving a track
+func Post[T any](data *T, sessionKey string, params map[string]string) error {
+	if sessionKey == "" {
+		return &Error{Code: ERROR_INVALID_SESSION_KEY, Message: "Not signed in to lastfm"}
+	}
 
-	req, err := http.NewRequest("GET", fullURL, nil)
+	return signedRequest(data, "POST", sessionKey, params)
+}
+
+func signedRequest[T any](data *T, method string, sessionKey string, params map[string]string) error {
+	conf, err := config.LoadConfig(false)
 	if err != nil {
+		log.Error("Error reading config file", "error", err)
 		return err
 	}
 
-	// Set the User-Agent header
+	values := url.Values{}
+	values.Add("api_key", conf.Auth.LastFM.ApiKey)
+	if sessionKey != "" {
+		values.Add("sk", sessionKey)
+	}
+	for key, value := range params {
+		values.Add(key, value)
+	}
+	values.Add("format", "json")
+	signParams(values, conf.Auth.LastFM.SharedSecret)
+	log.Info("signed request", "http method", method, "method", params["method"])
+
+	var req *http.Request
+	if method == "GET" {
+		req, err = http.NewRequest(method, LASTFM_API_URL+"?"+values.Encode(), nil)
+	} else {
+		req, err = http.NewRequest(method, LASTFM_API_URL, strings.NewReader(values.Encode()))
+		if req != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return err
+	}
 	req.Header.Set("User-Agent", "lastfm-spotify-syncer")
 
-	// Make the HTTP request
 	client := &http.Client{}
+	startedAt := time.Now()
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Error("Error making the request:", err)
+		metrics.ObserveLastFmRequest(params["method"], metrics.STATUS_ERROR, time.Since(startedAt))
+		log.Error("Error making the request:", "error", err)
 		return err
 	}
 	defer resp.Body.Close()
 
-	// Check the response status code
+	respData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		metrics.ObserveLastFmRequest(params["method"], metrics.STATUS_ERROR, time.Since(startedAt))
+		log.Error("Error reading response", "error", err)
+		return err
+	}
+
+	// Lastfm reports errors in the response body, so check for one before decoding
+	var apiErr Error
+	json.Unmarshal(respData, &apiErr)
+	observeRequest(params["method"], startedAt, resp.StatusCode, apiErr.Code)
+	if apiErr.Code != 0 {
+		log.Warn("lastfm returned an error", "code", apiErr.Code, "message", apiErr.Message)
+		return &apiErr
+	}
 	if resp.StatusCode != http.StatusOK {
 		log.Warn("failed", "error code", resp.StatusCode)
+		return fmt.Errorf("request failed with code: %d", resp.StatusCode)
 	}
-
-	// DEBUGGING
-	data2, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Error("error reading debug data", "error", err)
-		return err
+	// Methods like track.love have nothing to return
+	if len(strings.TrimSpace(string(respData))) == 0 {
+		return nil
 	}
-	log.Info("raw response", "data", string(data2))
 
-	// Decode the JSON response into the map
-	return json.Unmarshal(data2, &data)
-	// END DEBUGGING
+	return json.Unmarshal(respData, &data)
+}
+
+// Add the api_sig param lastfm needs for authenticated calls.
+// The signature is the md5 of every param name and value sorted by name, followed by the shared secret.
+// format and callback are left out of the signature
+func signParams(params url.Values, sharedSecret string) {
+	signed := url.Values{}
+	for key, value := range params {
+		if !unsignedParams[key] && key != "api_sig" {
+			signed[key] = value
+		}
+	}
 
-	// return json.NewDecoder(resp.Body).Decode(&data)
+	hashedSignature := encodeLastFmCall(getSortedMapKV(signed) + sharedSecret)
+	params.Set("api_sig", hashedSignature)
 }
 
 func getSortedMapKV(data url.Values) string {
@@ -164,7 +241,7 @@ func getSortedMapKV(data url.Values) string {
 		}
 	}
 
-	log.Info("sorted map", "values", output)
+	log.Debug("sorted map", "values", output)
 
 	return output
 }
@@ -179,17 +256,32 @@ func encodeLastFmCall(sortedParams string) string {
 	return hashHex
 }
 
-// Get the lastFM top tracks for a given period
-func GetTopTracks(period string, limit int, username string) (*TopTracks, error) {
-	var lastFmPeriod string
+// Convert a sync period into the period value the lastfm api expects
+func getLastFmPeriod(period string) (string, error) {
 	switch period {
 	case "weekly":
-		lastFmPeriod = "7day"
+		return "7day", nil
 	case "monthly":
-		lastFmPeriod = "1month"
+		return "1month", nil
+	case "overall":
+		return "overall", nil
 	default:
-		log.Error("Invalid period given for lastfm top tracks", "period", period)
-		return nil, errors.New("invalid period given")
+		log.Error("Invalid period given for lastfm", "period", period)
+		return "", errors.New("invalid period given")
+	}
+}
+
+// Get the lastFM top tracks for a given period
+func GetTopTracks(period string, limit int, username string) (*TopTracks, error) {
+	return GetTopTracksPage(period, limit, 1, username)
+}
+
+// Get a single page of the lastFM top tracks for a given period.
+// Pages start at 1, and each page holds limit tracks
+func GetTopTracksPage(period string, limit int, page int, username string) (*TopTracks, error) {
+	lastFmPeriod, err := getLastFmPeriod(period)
+	if err != nil {
+		return nil, err
 	}
 
 	params := map[string]string{
@@ -197,9 +289,124 @@ func GetTopTracks(period string, limit int, username string) (*TopTracks, error)
 		"user":   username,
 		"period": lastFmPeriod,
 		"limit":  strconv.Itoa(limit),
+		"page":   strconv.Itoa(page),
 	}
 
 	var topTracksData TopTracks
+	err = Get(
+		&topTracksData,
+		params,
+	)
+
+	return &topTracksData, err
+}
+
+// Get the lastFM top artists for a given period
+func GetTopArtists(period string, limit int, username string) (*TopArtists, error) {
+	lastFmPeriod, err := getLastFmPeriod(period)
+	if err != nil {
+		return nil, err
+	}
+
+	params := map[string]string{
+		"method": "user.getTopArtists",
+		"user":   username,
+		"period": lastFmPeriod,
+		"limit":  strconv.Itoa(limit),
+	}
+
+	var topArtistsData TopArtists
+	err = Get(
+		&topArtistsData,
+		params,
+	)
+
+	return &topArtistsData, err
+}
+
+// Get the most recently loved tracks for a user, up to the given limit.
+// This will page through the results as lastfm caps how many tracks are returned per request
+func GetLovedTracks(limit int, username string) (*LovedTracks, error) {
+	pageSize := min(limit, 1000)
+
+	var lovedTracksData LovedTracks
+	for page := 1; len(lovedTracksData.Lovedtracks.Track) < limit; page++ {
+		params := map[string]string{
+			"method": "user.getLovedTracks",
+			"user":   username,
+			"limit":  strconv.Itoa(pageSize),
+			"page":   strconv.Itoa(page),
+		}
+
+		var pageData LovedTracks
+		err := Get(&pageData, params)
+		if err != nil {
+			return nil, err
+		}
+
+		lovedTracksData.Lovedtracks.Attr = pageData.Lovedtracks.Attr
+		lovedTracksData.Lovedtracks.Track = append(lovedTracksData.Lovedtracks.Track, pageData.Lovedtracks.Track...)
+
+		totalPages, err := strconv.Atoi(pageData.Lovedtracks.Attr.TotalPages)
+		if err != nil || page >= totalPages || len(pageData.Lovedtracks.Track) == 0 {
+			break
+		}
+	}
+
+	if len(lovedTracksData.Lovedtracks.Track) > limit {
+		lovedTracksData.Lovedtracks.Track = lovedTracksData.Lovedtracks.Track[:limit]
+	}
+
+	return &lovedTracksData, nil
+}
+
+// Get the tracks lastfm considers similar to the given track
+func GetSimilarTracks(artist string, track string, limit int) (*SimilarTracks, error) {
+	params := map[string]string{
+		"method":      "track.getSimilar",
+		"artist":      artist,
+		"track":       track,
+		"autocorrect": "1",
+		"limit":       strconv.Itoa(limit),
+	}
+
+	var similarTracksData SimilarTracks
+	err := Get(
+		&similarTracksData,
+		params,
+	)
+
+	return &similarTracksData, err
+}
+
+// Get the artists lastfm considers similar to the given artist
+func GetSimilarArtists(artist string, limit int) (*SimilarArtists, error) {
+	params := map[string]string{
+		"method":      "artist.getSimilar",
+		"artist":      artist,
+		"autocorrect": "1",
+		"limit":       strconv.Itoa(limit),
+	}
+
+	var similarArtistsData SimilarArtists
+	err := Get(
+		&similarArtistsData,
+		params,
+	)
+
+	return &similarArtistsData, err
+}
+
+// Get an artist's most played tracks across all of lastfm
+func GetArtistTopTracks(artist string, limit int) (*ArtistTopTracks, error) {
+	params := map[string]string{
+		"method":      "artist.getTopTracks",
+		"artist":      artist,
+		"autocorrect": "1",
+		"limit":       strconv.Itoa(limit),
+	}
+
+	var topTracksData ArtistTopTracks
 	err := Get(
 		&topTracksData,
 		params,
@@ -207,3 +414,203 @@ func GetTopTracks(period string, limit int, username string) (*TopTracks, error)
 
 	return &topTracksData, err
 }
+
+// Get the info for a track.
+// If a username is given, the info will include that user's playcount for the track
+func GetTrackInfo(artist string, track string, username string) (*TrackInfo, error) {
+	params := map[string]string{
+		"method":      "track.getInfo",
+		"artist":      artist,
+		"track":       track,
+		"autocorrect": "1",
+	}
+	if username != "" {
+		params["username"] = username
+	}
+
+	var trackInfoData TrackInfo
+	err := Get(
+		&trackInfoData,
+		params,
+	)
+
+	return &trackInfoData, err
+}
+
+// Get the top tags applied to a track
+func GetTrackTopTags(artist string, track string) (*TopTags, error) {
+	params := map[string]string{
+		"method":      "track.getTopTags",
+		"artist":      artist,
+		"track":       track,
+		"autocorrect": "1",
+	}
+
+	var topTagsData TopTags
+	err := Get(
+		&topTagsData,
+		params,
+	)
+
+	return &topTagsData, err
+}
+
+// Get the top tags applied to an artist
+func GetArtistTopTags(artist string) (*TopTags, error) {
+	params := map[string]string{
+		"method":      "artist.getTopTags",
+		"artist":      artist,
+		"autocorrect": "1",
+	}
+
+	var topTagsData TopTags
+	err := Get(
+		&topTagsData,
+		params,
+	)
+
+	return &topTagsData, err
+}
+
+// Get a single page of the tracks a user has scrobbled between from and to, most recent first.
+// Pages start at 1, and each page holds up to limit tracks (max 200)
+func GetRecentTracksPage(from time.Time, to time.Time, limit int, page int, username string) (*RecentTracks, error) {
+	params := map[string]string{
+		"method": "user.getRecentTracks",
+		"user":   username,
+		"from":   strconv.FormatInt(from.Unix(), 10),
+		"to":     strconv.FormatInt(to.Unix(), 10),
+		"limit":  strconv.Itoa(limit),
+		"page":   strconv.Itoa(page),
+	}
+
+	var recentTracksData RecentTracks
+	err := Get(
+		&recentTracksData,
+		params,
+	)
+
+	return &recentTracksData, err
+}
+
+// Get the public profile info for a user
+func GetUserInfo(username string) (*UserInfo, error) {
+	params := map[string]string{
+		"method": "user.getInfo",
+		"user":   username,
+	}
+
+	var userInfoData UserInfo
+	err := Get(
+		&userInfoData,
+		params,
+	)
+
+	return &userInfoData, err
+}
+
+// Check the api key and username are valid by fetching the user's profile
+func CheckAuth(username string) (*UserInfo, error) {
+	return GetUserInfo(username)
+}
+
+// Love a track on lastfm for the user with the given session key
+func LoveTrack(sessionKey string, artist string, track string) error {
+	var data struct{}
+	return Post(&data, sessionKey, map[string]string{
+		"method": "track.love",
+		"artist": artist,
+		"track":  track,
+	})
+}
+
+// Unlove a track on lastfm for the user with the given session key
+func UnloveTrack(sessionKey string, artist string, track string) error {
+	var data struct{}
+	return Post(&data, sessionKey, map[string]string{
+		"method": "track.unlove",
+		"artist": artist,
+		"track":  track,
+	})
+}
+
+// Tell lastfm the user with the given session key has started playing a track.
+// Album and duration (in seconds) are optional
+func UpdateNowPlaying(sessionKey string, artist string, track string, album string, duration int) (*NowPlayingResponse, error) {
+	params := map[string]string{
+		"method": "track.updateNowPlaying",
+		"artist": artist,
+		"track":  track,
+	}
+	if album != "" {
+		params["album"] = album
+	}
+	if duration > 0 {
+		params["duration"] = strconv.Itoa(duration)
+	}
+
+	var nowPlayingData NowPlayingResponse
+	err := Post(&nowPlayingData, sessionKey, params)
+
+	return &nowPlayingData, err
+}
+
+// Tag a track on lastfm for the user with the given session key. Lastfm accepts up to 10 tags per call
+func AddTrackTags(sessionKey string, artist string, track string, tags []string) error {
+	var data struct{}
+	return Post(&data, sessionKey, map[string]string{
+		"method": "track.addTags",
+		"artist": artist,
+		"track":  track,
+		"tags":   strings.Join(tags, ","),
+	})
+}
+
+// The most scrobbles lastfm accepts in a single track.scrobble call
+const SCROBBLE_BATCH_SIZE = 50
+
+// A play to submit to lastfm. The timestamp is when the track started playing
+type Scrobble struct {
+	Artist    string
+	Track     string
+	Album     string
+	Timestamp time.Time
+	// In seconds, or 0 if unknown
+	Duration int
+}
+
+// Scrobble plays to lastfm for the user with the given session key, returning how many lastfm accepted and ignored.
+// Scrobbles are sent in batches as lastfm limits how many can be sent per call
+func ScrobbleTracks(sessionKey string, scrobbles []Scrobble) (int, int, error) {
+	accepted := 0
+	ignored := 0
+	for start := 0; start < len(scrobbles); start += SCROBBLE_BATCH_SIZE {
+		end := min(start+SCROBBLE_BATCH_SIZE, len(scrobbles))
+
+		params := map[string]string{
+			"method": "track.scrobble",
+		}
+		for i, v := range scrobbles[start:end] {
+			params[fmt.Sprintf("artist[%d]", i)] = v.Artist
+			params[fmt.Sprintf("track[%d]", i)] = v.Track
+			params[fmt.Sprintf("timestamp[%d]", i)] = strconv.FormatInt(v.Timestamp.Unix(), 10)
+			if v.Album != "" {
+				params[fmt.Sprintf("album[%d]", i)] = v.Album
+			}
+			if v.Duration > 0 {
+				params[fmt.Sprintf("duration[%d]", i)] = strconv.Itoa(v.Duration)
+			}
+		}
+
+		var scrobbleData ScrobbleResponse
+		err := Post(&scrobbleData, sessionKey, params)
+		if err != nil {
+			return accepted, ignored, err
+		}
+		accepted += scrobbleData.Scrobbles.Attr.Accepted
+		ignored += scrobbleData.Scrobbles.Attr.Ignored
+		log.Info("scrobbled batch", "accepted", scrobbleData.Scrobbles.Attr.Accepted, "ignored", scrobbleData.Scrobbles.Attr.Ignored)
+	}
+
+	return accepted, ignored, nil
+}
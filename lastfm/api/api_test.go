@@ -0,0 +1,109 @@
+package api
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestSignParams(t *testing.T) {
+	tests := []struct {
+		name   string
+		params url.Values
+		want   string
+	}{
+		{
+			// md5("api_keykeymethodauth.getSessiontokentoksecret")
+			name: "sorts params and leaves out format",
+			params: url.Values{
+				"token":   {"tok"},
+				"method":  {"auth.getSession"},
+				"api_key": {"key"},
+				"format":  {"json"},
+			},
+			want: "04e870be4bb79756721b7bc1937fe83d",
+		},
+		{
+			// md5("api_keykeyartistChermethodtrack.lovesksessiontrackBelievesecret")
+			name: "includes the session key and leaves out callback",
+			params: url.Values{
+				"method":   {"track.love"},
+				"artist":   {"Cher"},
+				"track":    {"Believe"},
+				"api_key":  {"key"},
+				"sk":       {"session"},
+				"format":   {"json"},
+				"callback": {"cb"},
+			},
+			want: "cd4d1cb1d8c0860d7983d8967f46f8db",
+		},
+		{
+			// md5("api_keykeyartist[0]Aartist[1]Bmethodtrack.scrobblesksessiontimestamp[0]100timestamp[1]200track[0]Xtrack[1]Ysecret")
+			name: "sorts indexed params for batch scrobbles",
+			params: url.Values{
+				"track[1]":     {"Y"},
+				"timestamp[1]": {"200"},
+				"artist[1]":    {"B"},
+				"track[0]":     {"X"},
+				"timestamp[0]": {"100"},
+				"artist[0]":    {"A"},
+				"method":       {"track.scrobble"},
+				"sk":           {"session"},
+				"api_key":      {"key"},
+				"format":       {"json"},
+			},
+			want: "f412cacb7c709203e44f9e7e150bba3e",
+		},
+		{
+			// md5("api_keykeymethodauth.getSessiontokentoksecret")
+			name: "replaces an existing signature",
+			params: url.Values{
+				"token":   {"tok"},
+				"method":  {"auth.getSession"},
+				"api_key": {"key"},
+				"api_sig": {"stale"},
+			},
+			want: "04e870be4bb79756721b7bc1937fe83d",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signParams(tt.params, "secret")
+
+			if got := tt.params.Get("api_sig"); got != tt.want {
+				t.Errorf("api_sig = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetSortedMapKV(t *testing.T) {
+	got := getSortedMapKV(url.Values{
+		"method":  {"track.love"},
+		"api_key": {"key"},
+		"artist":  {"Cher"},
+	})
+
+	want := "api_keykeyartistChermethodtrack.love"
+	if got != want {
+		t.Errorf("getSortedMapKV() = %q, want %q", got, want)
+	}
+}
+
+func TestPostRequiresSessionKey(t *testing.T) {
+	var data struct{}
+	err := Post(&data, "", map[string]string{
+		"method": "track.love",
+		"artist": "Cher",
+		"track":  "Believe",
+	})
+
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Code != ERROR_INVALID_SESSION_KEY {
+		t.Fatalf("Post() error = %v, want lastfm error %d", err, ERROR_INVALID_SESSION_KEY)
+	}
+	if !IsReauthRequired(err) {
+		t.Errorf("IsReauthRequired() = false, want true")
+	}
+}
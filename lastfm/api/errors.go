@@ -0,0 +1,41 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Lastfm error codes that mean the user's credentials are no longer valid
+const (
+	ERROR_AUTHENTICATION_FAILED = 4
+	ERROR_INVALID_SESSION_KEY   = 9
+	ERROR_INVALID_API_KEY       = 10
+	ERROR_UNAUTHORIZED_TOKEN    = 14
+	ERROR_TOKEN_EXPIRED         = 15
+	ERROR_SUSPENDED_API_KEY     = 26
+)
+
+// An error returned in the body of a lastfm api response
+type Error struct {
+	Code    int    `json:"error"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("lastfm error %d: %s", e.Code, e.Message)
+}
+
+// Whether the error means the user needs to re-authorize with lastfm, or fix their api key
+func IsReauthRequired(err error) bool {
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	switch apiErr.Code {
+	case ERROR_AUTHENTICATION_FAILED, ERROR_INVALID_SESSION_KEY, ERROR_INVALID_API_KEY, ERROR_UNAUTHORIZED_TOKEN, ERROR_TOKEN_EXPIRED, ERROR_SUSPENDED_API_KEY:
+		return true
+	default:
+		return false
+	}
+}
@@ -35,6 +35,20 @@ type TopTracks struct {
 	} `json:"toptracks"`
 }
 
+// The tags applied to a track or artist.
+// Count is the relative weight of the tag from 0-100, and is only included by the getTopTags methods
+type Tags struct {
+	Tag []struct {
+		Name  string `json:"name"`
+		URL   string `json:"url"`
+		Count int    `json:"count"`
+	} `json:"tag"`
+}
+
+type TopTags struct {
+	Toptags Tags `json:"toptags"`
+}
+
 type TrackInfo struct {
 	Track struct {
 		Name       string `json:"name"`
@@ -67,16 +81,235 @@ type TrackInfo struct {
 		} `json:"album"`
 		Userplaycount string `json:"userplaycount"`
 		Userloved     string `json:"userloved"`
-		Toptags       struct {
-			Tag []struct {
-				Name string `json:"name"`
-				URL  string `json:"url"`
-			} `json:"tag"`
-		} `json:"toptags"`
-		Wiki struct {
+		Toptags       Tags   `json:"toptags"`
+		Wiki          struct {
 			Published string `json:"published"`
 			Summary   string `json:"summary"`
 			Content   string `json:"content"`
 		} `json:"wiki"`
 	} `json:"track"`
 }
+
+type LovedTracks struct {
+	Lovedtracks struct {
+		Track []struct {
+			Artist struct {
+				URL  string `json:"url"`
+				Name string `json:"name"`
+				Mbid string `json:"mbid"`
+			} `json:"artist"`
+			Date struct {
+				Uts  string `json:"uts"`
+				Text string `json:"#text"`
+			} `json:"date"`
+			Mbid  string `json:"mbid"`
+			URL   string `json:"url"`
+			Name  string `json:"name"`
+			Image []struct {
+				Size string `json:"size"`
+				Text string `json:"#text"`
+			} `json:"image"`
+			Streamable struct {
+				Fulltrack string `json:"fulltrack"`
+				Text      string `json:"#text"`
+			} `json:"streamable"`
+		} `json:"track"`
+		Attr struct {
+			User       string `json:"user"`
+			TotalPages string `json:"totalPages"`
+			Page       string `json:"page"`
+			PerPage    string `json:"perPage"`
+			Total      string `json:"total"`
+		} `json:"@attr"`
+	} `json:"lovedtracks"`
+}
+
+type TopArtists struct {
+	Topartists struct {
+		Artist []struct {
+			Streamable string `json:"streamable"`
+			Image      []struct {
+				Size string `json:"size"`
+				Text string `json:"#text"`
+			} `json:"image"`
+			Mbid      string `json:"mbid"`
+			URL       string `json:"url"`
+			Playcount string `json:"playcount"`
+			Attr      struct {
+				Rank string `json:"rank"`
+			} `json:"@attr"`
+			Name string `json:"name"`
+		} `json:"artist"`
+		Attr struct {
+			User       string `json:"user"`
+			TotalPages string `json:"totalPages"`
+			Page       string `json:"page"`
+			PerPage    string `json:"perPage"`
+			Total      string `json:"total"`
+		} `json:"@attr"`
+	} `json:"topartists"`
+}
+
+type SimilarTracks struct {
+	Similartracks struct {
+		Track []struct {
+			Name       string  `json:"name"`
+			Playcount  int     `json:"playcount"`
+			Mbid       string  `json:"mbid"`
+			Match      float64 `json:"match"`
+			URL        string  `json:"url"`
+			Duration   int     `json:"duration"`
+			Streamable struct {
+				Text      string `json:"#text"`
+				Fulltrack string `json:"fulltrack"`
+			} `json:"streamable"`
+			Artist struct {
+				Name string `json:"name"`
+				Mbid string `json:"mbid"`
+				URL  string `json:"url"`
+			} `json:"artist"`
+			Image []struct {
+				Text string `json:"#text"`
+				Size string `json:"size"`
+			} `json:"image"`
+		} `json:"track"`
+		Attr struct {
+			Artist string `json:"artist"`
+		} `json:"@attr"`
+	} `json:"similartracks"`
+}
+
+type SimilarArtists struct {
+	Similarartists struct {
+		Artist []struct {
+			Name  string `json:"name"`
+			Mbid  string `json:"mbid"`
+			Match string `json:"match"`
+			URL   string `json:"url"`
+			Image []struct {
+				Text string `json:"#text"`
+				Size string `json:"size"`
+			} `json:"image"`
+			Streamable string `json:"streamable"`
+		} `json:"artist"`
+		Attr struct {
+			Artist string `json:"artist"`
+		} `json:"@attr"`
+	} `json:"similarartists"`
+}
+
+type ArtistTopTracks struct {
+	Toptracks struct {
+		Track []struct {
+			Name       string `json:"name"`
+			Playcount  string `json:"playcount"`
+			Listeners  string `json:"listeners"`
+			Mbid       string `json:"mbid"`
+			URL        string `json:"url"`
+			Streamable string `json:"streamable"`
+			Artist     struct {
+				Name string `json:"name"`
+				Mbid string `json:"mbid"`
+				URL  string `json:"url"`
+			} `json:"artist"`
+			Image []struct {
+				Text string `json:"#text"`
+				Size string `json:"size"`
+			} `json:"image"`
+			Attr struct {
+				Rank string `json:"rank"`
+			} `json:"@attr"`
+		} `json:"track"`
+		Attr struct {
+			Artist     string `json:"artist"`
+			Page       string `json:"page"`
+			PerPage    string `json:"perPage"`
+			TotalPages string `json:"totalPages"`
+			Total      string `json:"total"`
+		} `json:"@attr"`
+	} `json:"toptracks"`
+}
+
+type RecentTracks struct {
+	Recenttracks struct {
+		Track []struct {
+			Artist struct {
+				Mbid string `json:"mbid"`
+				Text string `json:"#text"`
+			} `json:"artist"`
+			Streamable string `json:"streamable"`
+			Image      []struct {
+				Size string `json:"size"`
+				Text string `json:"#text"`
+			} `json:"image"`
+			Mbid  string `json:"mbid"`
+			Album struct {
+				Mbid string `json:"mbid"`
+				Text string `json:"#text"`
+			} `json:"album"`
+			Name string `json:"name"`
+			URL  string `json:"url"`
+			Date struct {
+				Uts  string `json:"uts"`
+				Text string `json:"#text"`
+			} `json:"date"`
+			Attr struct {
+				Nowplaying string `json:"nowplaying"`
+			} `json:"@attr"`
+		} `json:"track"`
+		Attr struct {
+			User       string `json:"user"`
+			TotalPages string `json:"totalPages"`
+			Page       string `json:"page"`
+			PerPage    string `json:"perPage"`
+			Total      string `json:"total"`
+		} `json:"@attr"`
+	} `json:"recenttracks"`
+}
+
+type UserInfo struct {
+	User struct {
+		Name      string `json:"name"`
+		Realname  string `json:"realname"`
+		URL       string `json:"url"`
+		Country   string `json:"country"`
+		Playcount string `json:"playcount"`
+		Image     []struct {
+			Size string `json:"size"`
+			Text string `json:"#text"`
+		} `json:"image"`
+		Registered struct {
+			Unixtime string `json:"unixtime"`
+			Text     int    `json:"#text"`
+		} `json:"registered"`
+	} `json:"user"`
+}
+
+// The response to track.scrobble. Only the totals are used, as the per scrobble details vary in shape
+// depending on whether one or several tracks were sent
+type ScrobbleResponse struct {
+	Scrobbles struct {
+		Attr struct {
+			Accepted int `json:"accepted"`
+			Ignored  int `json:"ignored"`
+		} `json:"@attr"`
+	} `json:"scrobbles"`
+}
+
+// The response to track.updateNowPlaying, with any corrections lastfm made to the track
+type NowPlayingResponse struct {
+	Nowplaying struct {
+		Track struct {
+			Corrected string `json:"corrected"`
+			Text      string `json:"#text"`
+		} `json:"track"`
+		Artist struct {
+			Corrected string `json:"corrected"`
+			Text      string `json:"#text"`
+		} `json:"artist"`
+		IgnoredMessage struct {
+			Code string `json:"code"`
+			Text string `json:"#text"`
+		} `json:"ignoredMessage"`
+	} `json:"nowplaying"`
+}
@@ -1,26 +1,39 @@
 package main
 
 import (
+	"embed"
+	"errors"
 	"example/lastfm-spotify-syncer/config"
 	lastFmApi "example/lastfm-spotify-syncer/lastfm/api"
+	"example/lastfm-spotify-syncer/metrics"
 	"example/lastfm-spotify-syncer/scheduler"
 	spotifyApi "example/lastfm-spotify-syncer/spotify/api"
 	"example/lastfm-spotify-syncer/sync"
+	"flag"
 	"fmt"
-	"math/rand"
+	"html/template"
+	"io/fs"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
-	"text/template"
-	"time"
 
 	"github.com/charmbracelet/log"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/text/cases"
 	"golang.org/x/text/language"
 )
 
+// The templates and static files are built into the binary, so it can be run from any directory
+//
+//go:embed templates
+var templateFiles embed.FS
+
+//go:embed static
+var staticFiles embed.FS
+
 // Template function - used to convert a string to Title Case
 func toTitle(input string) string {
 	caser := cases.Title(language.English)
@@ -34,6 +47,12 @@ func main() {
 		log.Info("Error loading .env file. Either one not provided or running in prod mode")
 	}
 
+	configFilename := flag.String("config", os.Getenv("SYNCER_CONFIG"), "The config file. Defaults to config.json in the data dir. Env: SYNCER_CONFIG")
+	dataDir := flag.String("data-dir", os.Getenv("SYNCER_DATA_DIR"), "The directory to keep the config and other state in. Defaults to ./"+config.DEFAULT_DATA_DIR+". Env: SYNCER_DATA_DIR")
+	setPassword := flag.Bool("set-password", false, "Read a new admin password from stdin, save it and exit")
+	flag.Parse()
+	config.SetPaths(*dataDir, *configFilename)
+
 	if config.IsDev() {
 		log.SetLevel(log.DebugLevel)
 	} else {
@@ -45,6 +64,26 @@ func main() {
 	if err != nil {
 		log.Fatal("Cannot load config", "error", err)
 	}
+	if *setPassword {
+		err = setPasswordFromStdin()
+		if err != nil {
+			log.Fatal("Cannot set password", "error", err)
+		}
+		log.Info("Admin password set")
+		return
+	}
+
+	server, err := config.GetServer()
+	if err != nil {
+		log.Fatal("Cannot load server config", "error", err)
+	}
+	for _, warning := range server.Check() {
+		log.Warn(warning)
+	}
+	log.Info("Register these callback urls with lastfm and spotify", "lastfm", server.LastFMCallbackUrl(), "spotify", server.SpotifyRedirectUri())
+	if !conf.Config.Security.AuthEnabled() {
+		log.Warn("No admin password or proxy auth header is set, so anyone who can reach the app can change its settings. Run with --set-password to set one")
+	}
 
 	// Setup
 	router := gin.Default()
@@ -52,142 +91,254 @@ func main() {
 		router.ForwardedByClientIP = true
 		router.SetTrustedProxies([]string{"127.0.0.1"})
 	}
-	router.SetFuncMap(template.FuncMap{
+	templates, err := template.New("").Funcs(template.FuncMap{
 		"title": toTitle,
-	})
-	router.LoadHTMLGlob("templates/**/*.tmpl")
-	router.Static("/static", "./static")
+	}).ParseFS(templateFiles, "templates/*/*.tmpl")
+	if err != nil {
+		log.Fatal("Cannot load templates", "error", err)
+	}
+	router.SetHTMLTemplate(templates)
+	static, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		log.Fatal("Cannot load static files", "error", err)
+	}
+	router.StaticFS("/static", http.FS(static))
 
 	router.GET("/ping", getPing)
+	router.GET("/login", getLogin)
+	router.POST("/login", postLogin)
+
+	// Everything else needs signing in
+	admin := router.Group("", requireAuth)
+	registerApi(admin)
+	admin.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
 	// HTML routes
-	router.GET("/", func(c *gin.Context) {
+	admin.GET("/", func(c *gin.Context) {
 		conf, err := config.LoadConfig(false)
 		if err != nil {
 			log.Error("Error reading config", "error", err)
 			c.String(http.StatusInternalServerError, "Error reading config file")
 			return
 		}
-		signedIn := false
-		// TODO: Need the client ids and secrets to be checked too?
-		if conf.Auth.LastFM.Token != "" && conf.Auth.Spotify.RefreshToken != "" {
-			signedIn = true
+		user := getCurrentUser(c, conf)
+		authStatuses := []authStatus{
+			getLastFmAuthStatus(user),
+			getSpotifyAuthStatus(user),
+		}
+
+		var blends []map[string]any
+		for _, blend := range conf.Blends {
+			blends = append(blends, map[string]any{
+				"syncId":    blend.Id,
+				"syncUrl":   "/sync-blend/" + blend.Id,
+				"sync":      blend.Enabled,
+				"name":      blend.Name,
+				"period":    blend.Period,
+				"strategy":  blend.Strategy,
+				"usernames": strings.Join(blend.Usernames, ", "),
+				"csrfToken": csrfToken(c),
+			})
+		}
+		// Suggest blending everyone with a linked lastfm account
+		var blendUsernames []string
+		for _, u := range conf.Users {
+			if u.LastFM.Username != "" {
+				blendUsernames = append(blendUsernames, u.LastFM.Username)
+			}
 		}
 
+		// Show the most recent syncs first
+		history := make([]config.SyncRun, 0, len(user.History))
+		for i := len(user.History) - 1; i >= 0; i-- {
+			history = append(history, user.History[i])
+		}
+		signedIn := authStatuses[0].Ok && authStatuses[1].Ok
+
 		c.HTML(http.StatusOK, "index", gin.H{
-			// TODO: Better if these are a typesafe struct, but handle that later
-			"credentials": []map[string]string{
+			"credentials":        credentialFields(conf, user),
+			"problems":           userProblems(conf, user),
+			"envOverrides":       config.UserEnvOverrides(conf, user.Id),
+			"csrfToken":          csrfToken(c),
+			"authMethod":         c.GetString(authMethodKey),
+			"apiTokens":          conf.Config.Security.ApiTokens,
+			"users":              conf.Users,
+			"currentUser":        user,
+			"history":            history,
+			"blends":             blends,
+			"blendUsernames":     strings.Join(blendUsernames, ", "),
+			"signedIn":           signedIn,
+			"authStatuses":       authStatuses,
+			"spotifyRedirectUri": server.SpotifyRedirectUri(),
+			"sync": []map[string]any{
 				{
-					"id":    "lastfm-api-key",
-					"value": conf.Auth.LastFM.ApiKey,
-					"title": "LastFM Api Key",
+					"syncId":          "weekly",
+					"sync":            user.Sync.Weekly.Enabled,
+					"maxTracks":       user.Sync.Weekly.MaxTracks,
+					"source":          user.Sync.Weekly.Source,
+					"artistCount":     user.Sync.Weekly.ArtistCount,
+					"tracksPerArtist": user.Sync.Weekly.TracksPerArtist,
+					"artistTracks":    user.Sync.Weekly.ArtistTracks,
+					"includeTags":     strings.Join(user.Sync.Weekly.IncludeTags, ", "),
+					"excludeTags":     strings.Join(user.Sync.Weekly.ExcludeTags, ", "),
+					"minTagWeight":    user.Sync.Weekly.MinTagWeight,
+					"customCover":     user.Sync.Weekly.CustomCover,
 				},
 				{
-					"id":    "lastfm-shared-secret",
-					"value": conf.Auth.LastFM.SharedSecret,
-					"title": "LastFM Shared Secret",
+					"syncId":          "monthly",
+					"sync":            user.Sync.Monthly.Enabled,
+					"maxTracks":       user.Sync.Monthly.MaxTracks,
+					"source":          user.Sync.Monthly.Source,
+					"artistCount":     user.Sync.Monthly.ArtistCount,
+					"tracksPerArtist": user.Sync.Monthly.TracksPerArtist,
+					"artistTracks":    user.Sync.Monthly.ArtistTracks,
+					"includeTags":     strings.Join(user.Sync.Monthly.IncludeTags, ", "),
+					"excludeTags":     strings.Join(user.Sync.Monthly.ExcludeTags, ", "),
+					"minTagWeight":    user.Sync.Monthly.MinTagWeight,
+					"customCover":     user.Sync.Monthly.CustomCover,
 				},
 				{
-					"id":    "lastfm-username",
-					"value": conf.Auth.LastFM.Username,
-					"title": "LastFM username",
+					"syncId":        "loved",
+					"sync":          user.Sync.Loved.Enabled,
+					"maxTracks":     user.Sync.Loved.MaxTracks,
+					"removeUnloved": user.Sync.Loved.RemoveUnloved,
 				},
 				{
-					"id":    "spotify-client-id",
-					"value": conf.Auth.Spotify.ClientId,
-					"title": "Spotify Client Id",
+					"syncId":        "discovery",
+					"sync":          user.Sync.Discovery.Enabled,
+					"maxTracks":     user.Sync.Discovery.MaxTracks,
+					"seedPeriod":    user.Sync.Discovery.SeedPeriod,
+					"seedCount":     user.Sync.Discovery.SeedCount,
+					"minSimilarity": user.Sync.Discovery.MinSimilarity,
 				},
 				{
-					"id":    "spotify-client-secret",
-					"value": conf.Auth.Spotify.ClientSecret,
-					"title": "Spotify Client Secret",
+					"syncId":       "rediscovery",
+					"sync":         user.Sync.Rediscovery.Enabled,
+					"maxTracks":    user.Sync.Rediscovery.MaxTracks,
+					"months":       user.Sync.Rediscovery.Months,
+					"minPlaycount": user.Sync.Rediscovery.MinPlaycount,
 				},
-			},
-			"signedIn": signedIn,
-			"sync": []map[string]any{
 				{
-					"syncId":    "weekly",
-					"sync":      conf.Config.Sync.Weekly.Enabled,
-					"maxTracks": conf.Config.Sync.Weekly.MaxTracks,
+					"syncId": "recent",
+					"sync":   user.Sync.Recent.Enabled,
 				},
 				{
-					"syncId":    "monthly",
-					"sync":      conf.Config.Sync.Monthly.Enabled,
-					"maxTracks": conf.Config.Sync.Monthly.MaxTracks,
+					"syncId":          "liked",
+					"sync":            user.Sync.Liked.Enabled,
+					"likedSource":     user.Sync.Liked.Source,
+					"likedPlaylistId": user.Sync.Liked.PlaylistId,
 				},
 			},
 		})
 	})
 
 	// Endpoint to send links user needs to follow to auth with both services
-	router.GET("/authenticate-last-fm", authenticateLastFM)
-	router.GET("/authenticate-spotify", authenticateSpotify)
+	admin.GET("/authenticate-last-fm", authenticateLastFM)
+	admin.GET("/authenticate-spotify", authenticateSpotify)
 
 	// Endpoints to handle oauth callbacks
-	router.GET("/lastfm-auth", lastFmCallback)
-	router.GET("/spotify-auth", spotifyCallback)
+	admin.GET("/lastfm-auth", lastFmCallback)
+	admin.GET("/spotify-auth", spotifyCallback)
 
 	// Data endpoints
-	router.GET("/sync/:frequency", handleSync)
+	admin.POST("/sync/:frequency", handleSync)
+	admin.POST("/sync-blend/:blend", handleBlendSync)
+	admin.GET("/import", getImport)
+	admin.POST("/import", postImport)
 
 	// admin endpoints
-	router.POST("/admin/set-sync/:frequency", setSync)
-	router.POST("/admin/credentials", func(c *gin.Context) {
-		conf, err := config.LoadConfig(true)
-		if err != nil {
-			log.Error("Error reading config", "error", err)
-			c.String(http.StatusInternalServerError, "Error reading config file")
-			return
-		}
+	admin.POST("/admin/set-sync/:frequency", setSync)
+	admin.POST("/admin/users", addUser)
+	admin.POST("/admin/users/:user/delete", deleteUser)
+	admin.POST("/admin/blends", addBlend)
+	admin.POST("/admin/blends/:blend/toggle", toggleBlend)
+	admin.POST("/admin/blends/:blend/delete", deleteBlend)
+	admin.POST("/admin/tokens", addApiToken)
+	admin.POST("/admin/tokens/:token/delete", deleteApiToken)
+	admin.POST("/logout", postLogout)
+	admin.POST("/admin/credentials", saveCredentials)
 
-		type Credentials struct {
-			LastFMApiKey        string `form:"lastfm-api-key"`
-			LastFmSharedSecret  string `form:"lastfm-shared-secret"`
-			LastFmUsername      string `form:"lastfm-username"`
-			SpotifyClientId     string `form:"spotify-client-id"`
-			SpotifyClientSecret string `form:"spotify-client-secret"`
-		}
-		var credentials Credentials
-		err = c.Bind(&credentials)
-		if err != nil {
-			log.Error("Error reading form data", "error", err)
-			c.String(http.StatusInternalServerError, "Error reading form data")
-			return
+	// Setup scheduler
+	for _, user := range conf.Users {
+		if user.LastFM.ReauthRequired || user.Spotify.ReauthRequired {
+			log.Warn("Re-authorization required, the user's jobs are skipped until they authorise again", "user", user.Name)
 		}
+	}
+	err = scheduler.SetupSchedule(scheduledJobs(conf))
+	if err != nil {
+		log.Error("Error setting up scheduler, jobs will not fire", "err", err)
+	}
+	metrics.RegisterNextRuns(scheduler.NextRuns)
 
-		conf.Auth.LastFM.ApiKey = credentials.LastFMApiKey
-		conf.Auth.LastFM.SharedSecret = credentials.LastFmSharedSecret
-		conf.Auth.LastFM.Username = credentials.LastFmUsername
-		conf.Auth.Spotify.ClientId = credentials.SpotifyClientId
-		conf.Auth.Spotify.ClientSecret = credentials.SpotifyClientSecret
-		log.Debug("new lastfm api key is", "key", conf.Auth)
-
-		config.WriteConfig(conf)
-
-		c.Redirect(http.StatusFound, "/")
+	// Pick up changes made to the config file while running
+	config.Watch(func(before *config.Config, after *config.Config) {
+		scheduler.Reconcile(scheduledJobs(after))
+		if before.Config.Server != after.Config.Server {
+			log.Warn("Server settings have changed, restart the app for them to take effect")
+		}
 	})
 
-	// Setup scheduler
-	jobTags := [2]string{}
-	if conf.Config.Sync.Weekly.Enabled {
-		jobTags[0] = "weekly"
+	if server.UseTLS() {
+		log.Info("Listening with TLS", "address", server.Addr(), "url", server.BaseUrl)
+		err = router.RunTLS(server.Addr(), server.TlsCertFile, server.TlsKeyFile)
+	} else {
+		log.Info("Listening", "address", server.Addr(), "url", server.BaseUrl)
+		err = router.Run(server.Addr())
 	}
-	if conf.Config.Sync.Monthly.Enabled {
-		jobTags[1] = "monthly"
+	if err != nil {
+		log.Fatal("Error running server", "error", err)
 	}
+}
 
-	err = scheduler.SetupSchedule(jobTags[:])
+// Start or stop scheduled jobs to match the saved config.
+// A change to whether a sync is enabled may not take effect when it is overridden by an env var, so the jobs are
+// worked out from the saved config rather than the change
+func reconcileJobs() {
+	conf, err := config.LoadConfig(false)
 	if err != nil {
-		log.Error("Error setting up scheduler, jobs will not fire", "err", err)
+		log.Error("Error loading config, scheduled jobs may be out of date", "error", err)
+		return
+	}
+	scheduler.Reconcile(scheduledJobs(conf))
+}
+
+// The jobs to schedule for each user's enabled syncs and each enabled blend
+func scheduledJobs(conf *config.Config) []scheduler.Job {
+	var jobs []scheduler.Job
+	for _, user := range conf.Users {
+		for _, period := range user.EnabledPeriods() {
+			jobs = append(jobs, scheduler.Job{UserId: user.Id, Period: period})
+		}
+	}
+	for _, blend := range conf.Blends {
+		if blend.Enabled {
+			jobs = append(jobs, scheduler.Job{BlendId: blend.Id, Period: blend.Period})
+		}
 	}
 
-	router.Run(":8000")
+	return jobs
 }
 
 // Enable or disable the sync for a particular frequency
 func setSync(c *gin.Context) {
 	type SetSyncParams struct {
-		MaxTracks int `form:"max-tracks"`
+		MaxTracks       int     `form:"max-tracks"`
+		RemoveUnloved   bool    `form:"remove-unloved"`
+		Source          string  `form:"source"`
+		ArtistCount     int     `form:"artist-count"`
+		TracksPerArtist int     `form:"tracks-per-artist"`
+		ArtistTracks    string  `form:"artist-tracks"`
+		SeedPeriod      string  `form:"seed-period"`
+		SeedCount       int     `form:"seed-count"`
+		MinSimilarity   float64 `form:"min-similarity"`
+		IncludeTags     string  `form:"include-tags"`
+		ExcludeTags     string  `form:"exclude-tags"`
+		MinTagWeight    int     `form:"min-tag-weight"`
+		CustomCover     bool    `form:"custom-cover"`
+		Months          int     `form:"months"`
+		MinPlaycount    int     `form:"min-playcount"`
+		LikedSource     string  `form:"liked-source"`
+		LikedPlaylistId string  `form:"liked-playlist"`
 	}
 	var setSyncParams SetSyncParams
 	if err := c.ShouldBind(&setSyncParams); err != nil {
@@ -203,35 +354,139 @@ func setSync(c *gin.Context) {
 		c.String(http.StatusInternalServerError, "Error loading config file")
 		return
 	}
+	userId := getCurrentUser(c, conf).Id
 
 	validatedFrequency := strings.ToLower(frequency)
-	switch validatedFrequency {
-	case "weekly":
-		conf.Config.Sync.Weekly.Enabled = !conf.Config.Sync.Weekly.Enabled
-		conf.Config.Sync.Weekly.MaxTracks = setSyncParams.MaxTracks
-		if conf.Config.Sync.Weekly.Enabled {
-			scheduler.StartJob("weekly")
-		} else {
-			scheduler.StopJob("weekly")
+	err = config.Update(func(conf *config.Config) error {
+		user := conf.GetUser(userId)
+		if user == nil {
+			return errNotFound
 		}
-	case "monthly":
-		conf.Config.Sync.Monthly.Enabled = !conf.Config.Sync.Monthly.Enabled
-		conf.Config.Sync.Monthly.MaxTracks = setSyncParams.MaxTracks
-		if conf.Config.Sync.Monthly.Enabled {
-			scheduler.StartJob("monthly")
-		} else {
-			scheduler.StopJob("monthly")
+		before := invalidSettings(conf.Validate())
+
+		switch validatedFrequency {
+		case "weekly":
+			user.Sync.Weekly.Enabled = !user.Sync.Weekly.Enabled
+			user.Sync.Weekly.MaxTracks = setSyncParams.MaxTracks
+			user.Sync.Weekly.Source = setSyncParams.Source
+			user.Sync.Weekly.ArtistCount = setSyncParams.ArtistCount
+			user.Sync.Weekly.TracksPerArtist = setSyncParams.TracksPerArtist
+			user.Sync.Weekly.ArtistTracks = setSyncParams.ArtistTracks
+			user.Sync.Weekly.IncludeTags = splitTags(setSyncParams.IncludeTags)
+			user.Sync.Weekly.ExcludeTags = splitTags(setSyncParams.ExcludeTags)
+			user.Sync.Weekly.MinTagWeight = setSyncParams.MinTagWeight
+			user.Sync.Weekly.CustomCover = setSyncParams.CustomCover
+		case "monthly":
+			user.Sync.Monthly.Enabled = !user.Sync.Monthly.Enabled
+			user.Sync.Monthly.MaxTracks = setSyncParams.MaxTracks
+			user.Sync.Monthly.Source = setSyncParams.Source
+			user.Sync.Monthly.ArtistCount = setSyncParams.ArtistCount
+			user.Sync.Monthly.TracksPerArtist = setSyncParams.TracksPerArtist
+			user.Sync.Monthly.ArtistTracks = setSyncParams.ArtistTracks
+			user.Sync.Monthly.IncludeTags = splitTags(setSyncParams.IncludeTags)
+			user.Sync.Monthly.ExcludeTags = splitTags(setSyncParams.ExcludeTags)
+			user.Sync.Monthly.MinTagWeight = setSyncParams.MinTagWeight
+			user.Sync.Monthly.CustomCover = setSyncParams.CustomCover
+		case "loved":
+			user.Sync.Loved.Enabled = !user.Sync.Loved.Enabled
+			user.Sync.Loved.MaxTracks = setSyncParams.MaxTracks
+			user.Sync.Loved.RemoveUnloved = setSyncParams.RemoveUnloved
+		case "discovery":
+			user.Sync.Discovery.Enabled = !user.Sync.Discovery.Enabled
+			user.Sync.Discovery.MaxTracks = setSyncParams.MaxTracks
+			user.Sync.Discovery.SeedPeriod = setSyncParams.SeedPeriod
+			user.Sync.Discovery.SeedCount = setSyncParams.SeedCount
+			user.Sync.Discovery.MinSimilarity = setSyncParams.MinSimilarity
+		case "rediscovery":
+			user.Sync.Rediscovery.Enabled = !user.Sync.Rediscovery.Enabled
+			user.Sync.Rediscovery.MaxTracks = setSyncParams.MaxTracks
+			user.Sync.Rediscovery.Months = setSyncParams.Months
+			user.Sync.Rediscovery.MinPlaycount = setSyncParams.MinPlaycount
+		case "liked":
+			user.Sync.Liked.Enabled = !user.Sync.Liked.Enabled
+			user.Sync.Liked.Source = setSyncParams.LikedSource
+			user.Sync.Liked.PlaylistId = strings.TrimSpace(setSyncParams.LikedPlaylistId)
+		case "recent":
+			user.Sync.Recent.Enabled = !user.Sync.Recent.Enabled
+		default:
+			return errInvalidFrequency
 		}
-	default:
+		return newProblems(before, invalidSettings(conf.Validate()))
+	})
+	if errors.Is(err, errInvalidFrequency) {
 		log.Warn("Invalid value given", "value", frequency)
-		c.String(400, "Invalid value given; must be weekly or monthly")
+		c.String(400, "Invalid value given; must be weekly, monthly, loved, discovery, rediscovery, liked or recent")
+		return
+	}
+	if err != nil {
+		respondUpdateError(c, err, "No such user")
 		return
 	}
-	config.WriteConfig(conf)
+
+	reconcileJobs()
 
 	c.Redirect(http.StatusFound, "/")
 }
 
+// Returned from config updates when the user, blend etc. being changed doesn't exist
+var errNotFound = errors.New("not found")
+
+var errInvalidFrequency = errors.New("invalid frequency")
+
+// Respond to a failed config update, with a 404 if the thing being updated doesn't exist,
+// or a 400 if the change would leave settings with values that aren't allowed
+func respondUpdateError(c *gin.Context, err error, notFoundMessage string) {
+	if errors.Is(err, errNotFound) {
+		c.String(http.StatusNotFound, notFoundMessage)
+		return
+	}
+	var problemsErr *problemsError
+	if errors.As(err, &problemsErr) {
+		c.String(http.StatusBadRequest, "Invalid settings given; "+problemsErr.Error())
+		return
+	}
+
+	log.Error("Error saving config", "error", err)
+	c.String(http.StatusInternalServerError, "Error saving config file")
+}
+
+// The config problems affecting the user, including those affecting everyone
+func userProblems(conf *config.Config, user *config.User) []string {
+	var problems []string
+	for _, problem := range conf.Validate() {
+		if problem.UserId == "" || problem.UserId == user.Id {
+			problems = append(problems, problem.Message)
+		}
+	}
+
+	return problems
+}
+
+// Only the problems caused by settings with values that aren't allowed
+func invalidSettings(problems []config.ValidationError) []config.ValidationError {
+	var invalid []config.ValidationError
+	for _, problem := range problems {
+		if problem.Invalid {
+			invalid = append(invalid, problem)
+		}
+	}
+
+	return invalid
+}
+
+// Split a comma separated list of tags, dropping any empty values
+func splitTags(input string) []string {
+	var tags []string
+	for _, v := range strings.Split(input, ",") {
+		tag := strings.TrimSpace(v)
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
+
 // Handles the authorization callback from lastfm
 func lastFmCallback(c *gin.Context) {
 	type LastFmCallbackData struct {
@@ -243,10 +498,9 @@ func lastFmCallback(c *gin.Context) {
 	if err != nil {
 		log.Error("error reading token from last fm")
 	}
-	log.Info("received token", "token", lastFmCallbackData.Token)
 
 	data := lastFmApi.AuthData{}
-	lastFmApi.Authorize(&data, lastFmCallbackData.Token)
+	err = lastFmApi.Authorize(&data, lastFmCallbackData.Token)
 
 	if err != nil {
 		log.Error("error fetching session token", "error", err)
@@ -254,17 +508,29 @@ func lastFmCallback(c *gin.Context) {
 		return
 	}
 
-	log.Info("Response data", "data", data)
-	log.Info("key", "key", data.Session.Key)
+	log.Info("Received a lastfm session", "username", data.Session.Name)
 
 	// Now write this to file
 	conf, err := config.LoadConfig(false)
 	if err != nil {
 		log.Error("Error reading config file", "error", err)
 		c.String(http.StatusInternalServerError, "Error reading config file")
+		return
+	}
+	userId := getCurrentUser(c, conf).Id
+	err = config.Update(func(conf *config.Config) error {
+		user := conf.GetUser(userId)
+		if user == nil {
+			return errNotFound
+		}
+		user.LastFM.Token = data.Session.Key
+		user.LastFM.ReauthRequired = false
+		return nil
+	})
+	if err != nil {
+		respondUpdateError(c, err, "No such user")
+		return
 	}
-	conf.Auth.LastFM.Token = data.Session.Key
-	config.WriteConfig(conf)
 
 	c.Redirect(http.StatusFound, "/")
 }
@@ -274,6 +540,7 @@ func spotifyCallback(c *gin.Context) {
 	type SpotifyCallbackData struct {
 		Code  string `form:"code"`
 		State string `form:"state"`
+		Error string `form:"error"`
 	}
 	var spotifyCallbackData SpotifyCallbackData
 
@@ -283,11 +550,22 @@ func spotifyCallback(c *gin.Context) {
 		c.String(http.StatusInternalServerError, "Unable to read code from spotify")
 		return
 	}
-	log.Info("Spotify code", "code", spotifyCallbackData.Code)
+
+	codeVerifier, userId, err := verifyOAuthCookie(c, spotifyCallbackData.State)
+	if err != nil {
+		log.Warn("Invalid oauth state from spotify", "error", err)
+		c.String(http.StatusBadRequest, "Invalid or expired authorization request, please try authorising with spotify again")
+		return
+	}
+	if spotifyCallbackData.Error != "" {
+		log.Warn("Spotify authorization was not granted", "error", spotifyCallbackData.Error)
+		c.String(http.StatusBadRequest, "Spotify authorization failed: "+spotifyCallbackData.Error)
+		return
+	}
 
 	var authData config.SpotifyAuthData
 
-	err = spotifyApi.Authorize(&authData, spotifyCallbackData.Code)
+	err = spotifyApi.Authorize(&authData, spotifyCallbackData.Code, codeVerifier)
 	if err != nil {
 		log.Error("Error parsing json", "error", err)
 		c.String(http.StatusInternalServerError, "Error parsing spotify json")
@@ -295,14 +573,23 @@ func spotifyCallback(c *gin.Context) {
 	}
 
 	// Now write the tokens to file
-	conf, err := config.LoadConfig(false)
+	err = config.Update(func(conf *config.Config) error {
+		user := conf.GetUser(userId)
+		if user == nil {
+			return errNotFound
+		}
+		user.Spotify = authData
+		return nil
+	})
+	if errors.Is(err, errNotFound) {
+		log.Warn("User authorizing with spotify no longer exists", "user", userId)
+		c.String(http.StatusBadRequest, "The user being authorized no longer exists")
+		return
+	}
 	if err != nil {
-		log.Error("Error reading config file", "error", err)
-		c.String(http.StatusInternalServerError, "Error reading config file")
+		respondUpdateError(c, err, "")
 		return
 	}
-	conf.Auth.Spotify = authData
-	config.WriteConfig(conf)
 
 	c.Redirect(http.StatusFound, "/")
 }
@@ -315,8 +602,16 @@ func authenticateLastFM(c *gin.Context) {
 		c.String(http.StatusInternalServerError, "Error reading config file")
 		return
 	}
-	lastFmApiKey := conf.Auth.LastFM.ApiKey
-	link := "http://www.last.fm/api/auth/?api_key=" + lastFmApiKey
+	server, err := config.GetServer()
+	if err != nil {
+		log.Error("Error reading server config", "error", err)
+		c.String(http.StatusInternalServerError, "Error reading server config")
+		return
+	}
+	queryParams := url.Values{}
+	queryParams.Add("api_key", conf.Auth.LastFM.ApiKey)
+	queryParams.Add("cb", server.LastFMCallbackUrl())
+	link := "https://www.last.fm/api/auth/?" + queryParams.Encode()
 	log.Info("Please follow this url to authenticate lastFM", "link", link)
 	c.Redirect(http.StatusFound, link)
 }
@@ -330,15 +625,33 @@ func authenticateSpotify(c *gin.Context) {
 		return
 	}
 	spotifyClientId := conf.Auth.Spotify.ClientId
-	scopes := "playlist-read-private playlist-modify-private"
-	redirectUrl := "http://localhost:8000/spotify-auth"
+	scopes := "playlist-read-private playlist-modify-private user-library-read user-read-recently-played ugc-image-upload"
+	server, err := config.GetServer()
+	if err != nil {
+		log.Error("Error reading server config", "error", err)
+		c.String(http.StatusInternalServerError, "Error reading server config")
+		return
+	}
+	redirectUrl := server.SpotifyRedirectUri()
 	queryParams := url.Values{}
 	queryParams.Add("response_type", "code")
 	queryParams.Add("client_id", spotifyClientId)
 	queryParams.Add("scope", scopes)
 	queryParams.Add("redirect_uri", redirectUrl)
-	// TODO: put this into a cookie and compare the value in the next endpoint to make sure they haven't changed
-	queryParams.Add("state", randomString(16))
+
+	// The state and verifier are checked against the cookie when spotify redirects back
+	state := randomString(32)
+	codeVerifier, codeChallenge := generatePKCE()
+	user := getCurrentUser(c, conf)
+	err = setOAuthCookie(c, state, codeVerifier, user.Id, server.IsSecure())
+	if err != nil {
+		log.Error("Error signing oauth cookie", "error", err)
+		c.String(http.StatusInternalServerError, "Error starting spotify authorization")
+		return
+	}
+	queryParams.Add("state", state)
+	queryParams.Add("code_challenge_method", "S256")
+	queryParams.Add("code_challenge", codeChallenge)
 
 	queryString := queryParams.Encode()
 	spotifyURL := "https://accounts.spotify.com/authorize"
@@ -352,30 +665,27 @@ func getPing(c *gin.Context) {
 	c.IndentedJSON(http.StatusOK, "PONG")
 }
 
-// Handle manually syncing a given period
+// Handle manually syncing a given period for the current user
 func handleSync(c *gin.Context) {
 	frequency := c.Param("frequency")
-	err := sync.Sync(frequency)
+	conf, err := config.LoadConfig(false)
 	if err != nil {
-		log.Error("Error running sync", "error", err)
-		c.String(http.StatusInternalServerError, "Error running sync")
+		log.Error("Error reading config file", "error", err)
+		c.String(http.StatusInternalServerError, "Error reading config file")
 		return
 	}
+	user := getCurrentUser(c, conf)
 
-	c.HTML(http.StatusOK, "partial/sync-manually", nil)
-}
-
-// Generate a random string of given length
-func randomString(length int) string {
-	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-
-	seededRand := rand.New(
-		rand.NewSource(time.Now().UnixNano()))
-
-	b := make([]byte, length)
-	for i := range b {
-		b[i] = charset[seededRand.Intn(len(charset))]
+	err = sync.Sync(user.Id, frequency)
+	if err != nil {
+		log.Error("Error running sync", "error", err)
+		if sync.FlagReauthRequired(user.Id, err) {
+			c.String(http.StatusUnauthorized, "Re-authorization required")
+			return
+		}
+		c.String(http.StatusInternalServerError, "Error running sync")
+		return
 	}
 
-	return string(b)
+	c.HTML(http.StatusOK, "partial/sync-manually", gin.H{"syncId": frequency})
 }
@@ -0,0 +1,143 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const NAMESPACE = "syncer"
+
+// Status label for requests that failed without a response, e.g. because the connection failed
+const STATUS_ERROR = "error"
+
+var (
+	syncRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "sync_runs_total",
+		Help:      "Sync runs by period and outcome.",
+	}, []string{"period", "outcome"})
+
+	syncDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "sync_duration_seconds",
+		Help:      "How long sync runs take.",
+		Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800},
+	}, []string{"period"})
+
+	syncTracks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "sync_tracks_total",
+		Help:      "Tracks fetched by syncs, and how many were matched (added to a playlist, loved or scrobbled) or not.",
+	}, []string{"period", "status"})
+
+	spotifyRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "spotify_requests_total",
+		Help:      "Requests to the spotify api by endpoint, method and response status.",
+	}, []string{"endpoint", "method", "status"})
+
+	spotifyRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "spotify_request_duration_seconds",
+		Help:      "How long requests to the spotify api take.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint", "method"})
+
+	lastFmRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "lastfm_requests_total",
+		Help:      "Requests to the lastfm api by api method and response status. Errors lastfm reports in the response body are given as lastfm_<code>.",
+	}, []string{"method", "status"})
+
+	lastFmRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "lastfm_request_duration_seconds",
+		Help:      "How long requests to the lastfm api take.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	retries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "request_retries_total",
+		Help:      "Requests retried by service and reason.",
+	}, []string{"service", "reason"})
+
+	tokenRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "spotify_token_refreshes_total",
+		Help:      "Spotify access token refreshes by outcome.",
+	}, []string{"outcome"})
+)
+
+// Record a finished sync run, and the tracks it fetched and matched
+func ObserveSync(period string, outcome string, duration time.Duration, tracks int, matched int) {
+	syncRuns.WithLabelValues(period, outcome).Inc()
+	syncDuration.WithLabelValues(period).Observe(duration.Seconds())
+	syncTracks.WithLabelValues(period, "fetched").Add(float64(tracks))
+	syncTracks.WithLabelValues(period, "matched").Add(float64(matched))
+	if tracks > matched {
+		syncTracks.WithLabelValues(period, "unmatched").Add(float64(tracks - matched))
+	}
+}
+
+// Record a request to the spotify api. The endpoint should have any ids replaced, so there aren't too many series
+func ObserveSpotifyRequest(endpoint string, method string, status string, duration time.Duration) {
+	spotifyRequests.WithLabelValues(endpoint, method, status).Inc()
+	spotifyRequestDuration.WithLabelValues(endpoint, method).Observe(duration.Seconds())
+}
+
+// Record a request to the lastfm api, e.g. user.getTopTracks
+func ObserveLastFmRequest(method string, status string, duration time.Duration) {
+	lastFmRequests.WithLabelValues(method, status).Inc()
+	lastFmRequestDuration.WithLabelValues(method).Observe(duration.Seconds())
+}
+
+// Record a request being retried
+func Retry(service string, reason string) {
+	retries.WithLabelValues(service, reason).Inc()
+}
+
+// Record a spotify token refresh
+func TokenRefresh(err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "failed"
+	}
+	tokenRefreshes.WithLabelValues(outcome).Inc()
+}
+
+// The status label for a response status code
+func Status(code int) string {
+	return strconv.Itoa(code)
+}
+
+// Reports when each scheduled job will next run, read from the scheduler on each scrape
+type nextRunCollector struct {
+	desc     *prometheus.Desc
+	nextRuns func() map[string]time.Time
+}
+
+func (c *nextRunCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *nextRunCollector) Collect(ch chan<- prometheus.Metric) {
+	for job, nextRun := range c.nextRuns() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(nextRun.Unix()), job)
+	}
+}
+
+// Report the next run time of the scheduled jobs returned by nextRuns, keyed by job
+func RegisterNextRuns(nextRuns func() map[string]time.Time) {
+	prometheus.MustRegister(&nextRunCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(NAMESPACE, "scheduler", "next_run_timestamp_seconds"),
+			"When each scheduled job will next run, as a unix timestamp.",
+			[]string{"job"}, nil,
+		),
+		nextRuns: nextRuns,
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"example/lastfm-spotify-syncer/config"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The cookie used to carry the oauth state, PKCE verifier and user between the redirect to spotify and the callback
+const SPOTIFY_OAUTH_COOKIE = "spotify_oauth"
+
+// How long the user has to complete the spotify authorization before the state expires
+const OAUTH_STATE_TTL = 10 * time.Minute
+
+// The key used to sign cookies. It's kept in the config, so sessions and in-flight authorizations survive a restart
+func cookieSecret() ([]byte, error) {
+	conf, err := config.LoadConfig(false)
+	if err != nil {
+		return nil, err
+	}
+	key := conf.Config.Security.CookieKey()
+	if key == nil {
+		return nil, errors.New("no cookie secret in the config")
+	}
+
+	return key, nil
+}
+
+// Sign a value so it can be stored in a cookie and verified later.
+// The signed value includes an expiry time, after which it will no longer verify
+func signCookieValue(value string, expiresAt time.Time) (string, error) {
+	key, err := cookieSecret()
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString([]byte(value)) + "." + strconv.FormatInt(expiresAt.Unix(), 10)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+
+	return payload + "." + hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Verify a value signed with signCookieValue, returning the original value
+func verifyCookieValue(signed string) (string, error) {
+	parts := strings.Split(signed, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed cookie value")
+	}
+	payload := parts[0] + "." + parts[1]
+	key, err := cookieSecret()
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return "", errors.New("invalid cookie signature")
+	}
+
+	expiresAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", errors.New("malformed cookie expiry")
+	}
+	if time.Now().Unix() > expiresAt {
+		return "", errors.New("cookie has expired")
+	}
+
+	value, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", errors.New("malformed cookie value")
+	}
+
+	return string(value), nil
+}
+
+// Store the oauth state, PKCE verifier and the user being authorized in a short lived signed cookie
+func setOAuthCookie(c *gin.Context, state string, codeVerifier string, userId string, secure bool) error {
+	value, err := signCookieValue(state+":"+codeVerifier+":"+userId, time.Now().Add(OAUTH_STATE_TTL))
+	if err != nil {
+		return err
+	}
+	// Lax is needed so the cookie is sent on the redirect back from spotify
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(SPOTIFY_OAUTH_COOKIE, value, int(OAUTH_STATE_TTL.Seconds()), "/spotify-auth", "", secure, true)
+
+	return nil
+}
+
+// Check the state returned by spotify matches the one stored in the oauth cookie, returning the PKCE verifier
+// and the user being authorized. The cookie is cleared either way, so it can only be used once
+func verifyOAuthCookie(c *gin.Context, state string) (string, string, error) {
+	cookie, err := c.Cookie(SPOTIFY_OAUTH_COOKIE)
+	c.SetCookie(SPOTIFY_OAUTH_COOKIE, "", -1, "/spotify-auth", "", false, true)
+	if err != nil {
+		return "", "", errors.New("missing oauth cookie")
+	}
+
+	value, err := verifyCookieValue(cookie)
+	if err != nil {
+		return "", "", err
+	}
+
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return "", "", errors.New("malformed oauth cookie")
+	}
+	expectedState, codeVerifier, userId := parts[0], parts[1], parts[2]
+	if subtle.ConstantTimeCompare([]byte(expectedState), []byte(state)) != 1 {
+		return "", "", errors.New("oauth state does not match")
+	}
+
+	return codeVerifier, userId, nil
+}
+
+// Generate a PKCE code verifier and its S256 challenge
+func generatePKCE() (string, string) {
+	codeVerifier := randomString(64)
+	hash := sha256.Sum256([]byte(codeVerifier))
+	codeChallenge := base64.RawURLEncoding.EncodeToString(hash[:])
+
+	return codeVerifier, codeChallenge
+}
+
+// Generate a cryptographically random string of given length
+func randomString(length int) string {
+	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+	b := make([]byte, length)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
+		if err != nil {
+			panic(fmt.Sprintf("unable to generate random string: %s", err))
+		}
+		b[i] = charset[n.Int64()]
+	}
+
+	return string(b)
+}
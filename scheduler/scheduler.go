@@ -2,6 +2,7 @@ package scheduler
 
 import (
 	"errors"
+	"example/lastfm-spotify-syncer/config"
 	"example/lastfm-spotify-syncer/sync"
 	"os"
 	"time"
@@ -40,16 +41,38 @@ func StopScheduler() {
 	log.Info("Scheduler jobs paused")
 }
 
-// Start either the weekly or monthly job, depending on which tag given
-// Tag values can be 'weekly' or 'monthly' or an error is returned
-func StartJob(tag string) error {
+// A scheduled sync for a user, or for a blend if the blend id is set
+type Job struct {
+	UserId  string
+	BlendId string
+	Period  string
+}
+
+// The tag for a user's job. Each user has their own job for each period
+func jobTag(userId string, period string) string {
+	return userId + "/" + period
+}
+
+// Start either the weekly, monthly, loved, discovery, rediscovery, liked or recent job for a user, depending on which period given
+// Period values can be 'weekly', 'monthly', 'loved', 'discovery', 'rediscovery', 'liked' or 'recent' or an error is returned
+func StartJob(userId string, period string) error {
 	s := GetScheduler()
 	var err error
-	switch tag {
+	switch period {
 	case "weekly":
-		err = startWeeklyJob(s)
+		err = startWeeklyJob(s, userId)
 	case "monthly":
-		err = startMonthlyJob(s)
+		err = startMonthlyJob(s, userId)
+	case "loved":
+		err = startLovedJob(s, userId)
+	case "discovery":
+		err = startDiscoveryJob(s, userId)
+	case "rediscovery":
+		err = startRediscoveryJob(s, userId)
+	case "liked":
+		err = startLikedJob(s, userId)
+	case "recent":
+		err = startRecentJob(s, userId)
 	default:
 		err = errors.New("invalid tag given")
 	}
@@ -61,16 +84,14 @@ func StartJob(tag string) error {
 	return nil
 }
 
-// Stop either the weekly or monthly job, depending on which tag given
-// Tag values can be 'weekly' or 'monthly' or an error is returned
-func StopJob(tag string) error {
+// Stop either the weekly, monthly, loved, discovery, rediscovery, liked or recent job for a user, depending on which period given
+// Period values can be 'weekly', 'monthly', 'loved', 'discovery', 'rediscovery', 'liked' or 'recent' or an error is returned
+func StopJob(userId string, period string) error {
 	s := GetScheduler()
 	var err error
-	switch tag {
-	case "weekly":
-		fallthrough
-	case "monthly":
-		err = s.RemoveByTag(tag)
+	switch period {
+	case "weekly", "monthly", "loved", "discovery", "rediscovery", "liked", "recent":
+		err = s.RemoveByTag(jobTag(userId, period))
 	default:
 		err = errors.New("invalid tag given")
 	}
@@ -78,55 +99,284 @@ func StopJob(tag string) error {
 		return err
 	}
 
-	log.Info("Stopped job", "tag", tag)
+	log.Info("Stopped job", "user", userId, "period", period)
+	return nil
+}
+
+// Stop all of a user's jobs, e.g. because the user has been removed
+func StopUserJobs(userId string) {
+	s := GetScheduler()
+	for _, period := range []string{"weekly", "monthly", "loved", "discovery", "rediscovery", "liked", "recent"} {
+		// Most users won't have every job, so a missing job isn't an error here
+		s.RemoveByTag(jobTag(userId, period))
+	}
+	log.Info("Stopped all jobs", "user", userId)
+}
+
+func startLikedJob(s *gocron.Scheduler, userId string) error {
+	_, err := s.Every(1).Day().Tag(jobTag(userId, "liked")).Do(runJob, userId, "liked")
+	if err != nil {
+		log.Error("Error scheduling liked job", "user", userId, "error", err)
+		return err
+	}
+
+	log.Info("Liked job scheduled", "user", userId)
+	return nil
+}
+
+// Spotify only keeps the last 50 plays, so this needs to run often enough not to miss any
+func startRecentJob(s *gocron.Scheduler, userId string) error {
+	_, err := s.Every(1).Hour().Tag(jobTag(userId, "recent")).Do(runJob, userId, "recent")
+	if err != nil {
+		log.Error("Error scheduling recently played job", "user", userId, "error", err)
+		return err
+	}
+
+	log.Info("Recently played job scheduled", "user", userId)
+	return nil
+}
+
+// Start the job for a blend, running either weekly or monthly depending on the blend's period
+func StartBlendJob(blendId string, period string) error {
+	s := GetScheduler()
+	return startBlendJob(s, blendId, period)
+}
+
+// Stop the job for a blend
+func StopBlendJob(blendId string) error {
+	s := GetScheduler()
+	err := s.RemoveByTag(jobTag("blend", blendId))
+	if err != nil {
+		return err
+	}
+
+	log.Info("Stopped blend job", "blend", blendId)
 	return nil
 }
 
-func startWeeklyJob(s *gocron.Scheduler) error {
-	_, err := s.Every(1).Week().Tag("weekly").Do(func() {
-		log.Info("Running weekly sync job...")
-		sync.Sync("weekly")
-		log.Info("Sync job complete")
-	})
+// Run the sync for a user's job.
+// Syncs are skipped while the user needs to re-authorize with lastfm or spotify, and resume once they do
+func runJob(userId string, period string) {
+	conf, err := config.LoadConfig(false)
 	if err != nil {
-		log.Error("Error scheduling weekly job", "error", err)
+		log.Error("Error loading config", "error", err)
+		return
+	}
+	user := conf.GetUser(userId)
+	if user == nil {
+		log.Warn("Skipping sync job for removed user", "user", userId, "period", period)
+		return
+	}
+	if user.LastFM.ReauthRequired || user.Spotify.ReauthRequired {
+		log.Warn("Skipping sync job until the user re-authorizes", "user", userId, "period", period)
+		return
+	}
+
+	log.Info("Running sync job...", "user", userId, "period", period)
+	err = sync.Sync(userId, period)
+	if err != nil {
+		log.Error("Sync job failed", "user", userId, "period", period, "error", err)
+		if sync.FlagReauthRequired(userId, err) {
+			log.Warn("Re-authorization required, the user's jobs will be skipped until they do", "user", userId)
+		}
+		return
+	}
+	log.Info("Sync job complete", "user", userId, "period", period)
+}
+
+func startWeeklyJob(s *gocron.Scheduler, userId string) error {
+	_, err := s.Every(1).Week().Tag(jobTag(userId, "weekly")).Do(runJob, userId, "weekly")
+	if err != nil {
+		log.Error("Error scheduling weekly job", "user", userId, "error", err)
 		return err
 	}
 
-	log.Info("Weekly job scheduled")
+	log.Info("Weekly job scheduled", "user", userId)
 	return nil
 }
 
-func startMonthlyJob(s *gocron.Scheduler) error {
-	_, err := s.Every(1).Month(1).Tag("monthly").Do(func() {
-		log.Info("Running monthly sync job...")
-		sync.Sync("monthly")
-		log.Info("Sync job complete")
-	})
+func startMonthlyJob(s *gocron.Scheduler, userId string) error {
+	_, err := s.Every(1).Month(1).Tag(jobTag(userId, "monthly")).Do(runJob, userId, "monthly")
 	if err != nil {
-		log.Error("Error scheduling monthly job", "error", err)
+		log.Error("Error scheduling monthly job", "user", userId, "error", err)
 		return err
 	}
 
-	log.Info("Monthly job scheduled")
+	log.Info("Monthly job scheduled", "user", userId)
 	return nil
 }
 
+func startLovedJob(s *gocron.Scheduler, userId string) error {
+	_, err := s.Every(1).Day().Tag(jobTag(userId, "loved")).Do(runJob, userId, "loved")
+	if err != nil {
+		log.Error("Error scheduling loved job", "user", userId, "error", err)
+		return err
+	}
+
+	log.Info("Loved job scheduled", "user", userId)
+	return nil
+}
+
+func startDiscoveryJob(s *gocron.Scheduler, userId string) error {
+	_, err := s.Every(1).Week().Tag(jobTag(userId, "discovery")).Do(runJob, userId, "discovery")
+	if err != nil {
+		log.Error("Error scheduling discovery job", "user", userId, "error", err)
+		return err
+	}
+
+	log.Info("Discovery job scheduled", "user", userId)
+	return nil
+}
+
+func startRediscoveryJob(s *gocron.Scheduler, userId string) error {
+	_, err := s.Every(1).Week().Tag(jobTag(userId, "rediscovery")).Do(runJob, userId, "rediscovery")
+	if err != nil {
+		log.Error("Error scheduling rediscovery job", "user", userId, "error", err)
+		return err
+	}
+
+	log.Info("Rediscovery job scheduled", "user", userId)
+	return nil
+}
+
+// Run the sync for a blend's job.
+// Like the user's own jobs, blends are skipped while their owner needs to re-authorize
+func runBlendJob(blendId string) {
+	conf, err := config.LoadConfig(false)
+	if err != nil {
+		log.Error("Error loading config", "error", err)
+		return
+	}
+	blend := conf.GetBlend(blendId)
+	if blend == nil {
+		log.Warn("Skipping sync job for removed blend", "blend", blendId)
+		return
+	}
+	owner := conf.GetUser(blend.OwnerId)
+	if owner != nil && (owner.LastFM.ReauthRequired || owner.Spotify.ReauthRequired) {
+		log.Warn("Skipping blend job until the owner re-authorizes", "blend", blend.Name, "owner", owner.Name)
+		return
+	}
+	ownerId := blend.OwnerId
+
+	log.Info("Running blend job...", "blend", blendId)
+	err = sync.SyncBlend(blendId)
+	if err != nil {
+		log.Error("Blend job failed", "blend", blendId, "error", err)
+		sync.FlagReauthRequired(ownerId, err)
+		return
+	}
+	log.Info("Blend job complete", "blend", blendId)
+}
+
+func startBlendJob(s *gocron.Scheduler, blendId string, period string) error {
+	var err error
+	// The second tag records the period, so a change to it can be spotted when reconciling
+	tags := []string{jobTag("blend", blendId), jobTag("blend", blendId) + "/" + period}
+	switch period {
+	case "weekly":
+		_, err = s.Every(1).Week().Tag(tags...).Do(runBlendJob, blendId)
+	case "monthly":
+		_, err = s.Every(1).Month(1).Tag(tags...).Do(runBlendJob, blendId)
+	default:
+		err = errors.New("invalid period given")
+	}
+	if err != nil {
+		log.Error("Error scheduling blend job", "blend", blendId, "error", err)
+		return err
+	}
+
+	log.Info("Blend job scheduled", "blend", blendId, "period", period)
+	return nil
+}
+
+// Bring the scheduled jobs in line with the given jobs, e.g. after the config has been changed outside the app.
+// Missing jobs are started, jobs not given are stopped, and blends whose period has changed are rescheduled
+func Reconcile(jobs []Job) {
+	s := GetScheduler()
+	scheduled := make(map[string]bool)
+	for _, job := range s.Jobs() {
+		for _, tag := range job.Tags() {
+			scheduled[tag] = true
+		}
+	}
+
+	wanted := make(map[string]bool)
+	for _, job := range jobs {
+		if job.BlendId == "" {
+			tag := jobTag(job.UserId, job.Period)
+			wanted[tag] = true
+			if !scheduled[tag] {
+				StartJob(job.UserId, job.Period)
+			}
+			continue
+		}
+
+		tag := jobTag("blend", job.BlendId)
+		wanted[tag] = true
+		if scheduled[tag+"/"+job.Period] {
+			continue
+		}
+		if scheduled[tag] {
+			log.Info("Rescheduling blend job", "blend", job.BlendId, "period", job.Period)
+			StopBlendJob(job.BlendId)
+		}
+		StartBlendJob(job.BlendId, job.Period)
+	}
+
+	for _, job := range s.Jobs() {
+		tags := job.Tags()
+		if len(tags) == 0 || wanted[tags[0]] {
+			continue
+		}
+		s.RemoveByTag(tags[0])
+		log.Info("Stopped job", "job", tags[0])
+	}
+}
+
+// When each scheduled job will next run, keyed by the job's tag, e.g. default/weekly or blend/<id>
+func NextRuns() map[string]time.Time {
+	nextRuns := make(map[string]time.Time)
+	for _, job := range GetScheduler().Jobs() {
+		tags := job.Tags()
+		if len(tags) == 0 {
+			continue
+		}
+		nextRuns[tags[0]] = job.NextRun()
+	}
+
+	return nextRuns
+}
+
 // Setup the scheduler and jobs for use later
-// The jobs to enable must be given by passing in a slice of the tags to enable.
-// These values must be 'weekly' or 'monthly'. Other values will be ignored. Duplicates will be ignored
-func SetupSchedule(jobTags []string) error {
+// The jobs to enable must be given by passing in a slice of each user's jobs.
+// Periods must be 'weekly', 'monthly', 'loved', 'discovery', 'rediscovery', 'liked' or 'recent'. Other values will be ignored. Duplicates will be ignored
+func SetupSchedule(jobs []Job) error {
 	s := GetScheduler()
 	s.WaitForScheduleAll()
 	s.TagsUnique()
 
 	var err error
-	for _, tag := range jobTags {
-		switch tag {
+	for _, job := range jobs {
+		if job.BlendId != "" {
+			err = startBlendJob(s, job.BlendId, job.Period)
+			continue
+		}
+		switch job.Period {
 		case "weekly":
-			err = startWeeklyJob(s)
+			err = startWeeklyJob(s, job.UserId)
 		case "monthly":
-			err = startMonthlyJob(s)
+			err = startMonthlyJob(s, job.UserId)
+		case "loved":
+			err = startLovedJob(s, job.UserId)
+		case "discovery":
+			err = startDiscoveryJob(s, job.UserId)
+		case "rediscovery":
+			err = startRediscoveryJob(s, job.UserId)
+		case "liked":
+			err = startLikedJob(s, job.UserId)
+		case "recent":
+			err = startRecentJob(s, job.UserId)
 		}
 	}
 	if err != nil {
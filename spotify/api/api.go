@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,8 +18,41 @@ import (
 
 const SPOTIFY_API_URL = "https://api.spotify.com/v1"
 
-// Complete authorization with spotify
-func Authorize(authData *config.SpotifyAuthData, code string) error {
+// The max number of items spotify will accept when adding or removing playlist tracks in one request
+const PLAYLIST_ITEMS_LIMIT = 100
+
+// Returned when spotify responds with an unexpected http status code
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("request failed with code: %d", e.StatusCode)
+}
+
+// The path segments followed by an id in spotify api urls
+var idSegments = map[string]bool{
+	"albums":    true,
+	"artists":   true,
+	"playlists": true,
+	"users":     true,
+}
+
+// The endpoint of a spotify api url for metrics, with any ids replaced, e.g. /playlists/{id}/tracks
+func endpointLabel(path string) string {
+	segments := strings.Split(strings.TrimPrefix(path, "/v1"), "/")
+	for i := 1; i < len(segments); i++ {
+		if idSegments[segments[i-1]] && segments[i] != "" {
+			segments[i] = "{id}"
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// Complete authorization with spotify.
+// If a PKCE code verifier is given it is sent in place of the client secret
+func Authorize(authData *config.SpotifyAuthData, code string, codeVerifier string) error {
 	conf, err := config.LoadConfig(false)
 	if err != nil {
 		log.Error("Error reading config file", "error", err)
@@ -26,25 +60,35 @@ func Authorize(authData *config.SpotifyAuthData, code string) error {
 	}
 	clientID := conf.Auth.Spotify.ClientId
 	clientSecret := conf.Auth.Spotify.ClientSecret
-	redirectURI := "http://localhost:8000/spotify-auth"
+	server, err := config.GetServer()
+	if err != nil {
+		log.Error("Error reading server config", "error", err)
+		return err
+	}
+	redirectURI := server.SpotifyRedirectUri()
 
 	// Build the request data
 	data := url.Values{}
 	data.Set("code", code)
 	data.Set("redirect_uri", redirectURI)
 	data.Set("grant_type", "authorization_code")
-
-	// Create a basic authentication header
-	authHeader := base64.StdEncoding.EncodeToString([]byte(clientID + ":" + clientSecret))
+	if codeVerifier != "" {
+		data.Set("client_id", clientID)
+		data.Set("code_verifier", codeVerifier)
+	}
 
 	// Create an HTTP request
-	req, err := http.NewRequest("POST", "https://accounts.spotify.com/api/token", bytes.NewBufferString(data.Encode()))
+	req, err := http.NewRequest("POST", SPOTIFY_TOKEN_URL, bytes.NewBufferString(data.Encode()))
 	if err != nil {
 		log.Error("Error creating request:", "error", err)
 		return err
 	}
 
-	req.Header.Set("Authorization", "Basic "+authHeader)
+	if codeVerifier == "" {
+		// Create a basic authentication header
+		authHeader := base64.StdEncoding.EncodeToString([]byte(clientID + ":" + clientSecret))
+		req.Header.Set("Authorization", "Basic "+authHeader)
+	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
 	// Make the HTTP request
@@ -57,162 +101,115 @@ func Authorize(authData *config.SpotifyAuthData, code string) error {
 	defer resp.Body.Close()
 
 	// Check the response
-	if resp.Status != "200 OK" {
+	if resp.StatusCode != http.StatusOK {
 		log.Error("Error: HTTP Status", "status", resp.Status)
-		return nil
+		return &StatusError{StatusCode: resp.StatusCode}
 	}
 
 	err = json.NewDecoder(resp.Body).Decode(&authData)
-	authData.ClientId = clientID
-	authData.ClientSecret = clientSecret
+	authData.Pkce = codeVerifier != ""
 
-	expiresIn := time.Duration(conf.Auth.Spotify.ExpiresIn) * time.Second
+	expiresIn := time.Duration(authData.ExpiresIn) * time.Second
 	expiresAt := time.Now().Add(expiresIn)
 	authData.ExpiresAt = expiresAt
 
 	return err
 }
 
-func GetAuth() (*config.SpotifyAuthData, error) {
-	conf, err := config.LoadConfig(false)
-	if err != nil {
-		log.Error("Error fetching config", "error", err)
-		return nil, err
-	}
+func Get[T any](userId string, data *T, endpoint string, params map[string]string) error {
+	// Create the full endpoint
+	completeEndpoint := SPOTIFY_API_URL + endpoint
 
-	// No need to refresh the token if it hasn't expired
-	expired := conf.Auth.Spotify.ExpiresAt.Before(time.Now())
-	if !expired {
-		return &conf.Auth.Spotify, nil
-	}
+	// Create a map of query parameters
+	queryParams := url.Values{}
 
-	err = refreshToken(&conf.Auth.Spotify)
-	if err != nil {
-		log.Error("Error refreshing token")
-		return nil, err
+	for key, value := range params {
+		queryParams.Add(key, value)
 	}
 
-	// Set the expiry time
-	expiresIn := time.Duration(conf.Auth.Spotify.ExpiresIn) * time.Second
-	expiresAt := time.Now().Add(expiresIn)
-	conf.Auth.Spotify.ExpiresAt = expiresAt
-
-	config.WriteConfig(conf)
+	// Encode the query parameters into a URL-encoded string
+	query := queryParams.Encode()
 
-	return &conf.Auth.Spotify, nil
-}
+	// Build the complete URL with query parameters
+	fullURL := fmt.Sprintf("%s?%s", completeEndpoint, query)
+	log.Info("full URL", "url", fullURL)
 
-func refreshToken(authData *config.SpotifyAuthData) error {
-	conf, err := config.LoadConfig(false)
+	resp, err := doRequest(userId, "GET", fullURL, nil)
 	if err != nil {
-		log.Error("Error reading config file", "error", err)
 		return err
 	}
-	clientID := conf.Auth.Spotify.ClientId
-	clientSecret := conf.Auth.Spotify.ClientSecret
-	refreshToken := authData.RefreshToken
+	defer resp.Body.Close()
 
-	// Define the URL for the token endpoint
-	spotifyUrl := "https://accounts.spotify.com/api/token"
+	// Check the response status code
+	if resp.StatusCode != http.StatusOK {
+		log.Warn("failed", "error code", resp.StatusCode)
+		return &StatusError{StatusCode: resp.StatusCode}
+	}
 
-	// Create a URL-encoded request body
-	data := url.Values{}
-	data.Set("grant_type", "refresh_token")
-	data.Set("refresh_token", refreshToken)
+	// Decode the JSON response into the map
+	return json.NewDecoder(resp.Body).Decode(&data)
+}
 
-	// Create an HTTP request with the request body
-	payload := strings.NewReader(data.Encode())
-	req, err := http.NewRequest("POST", spotifyUrl, payload)
+func Post[T any, B any](userId string, data *T, endpoint string, body *B) error {
+	// Create the full endpoint
+	completeEndpoint := SPOTIFY_API_URL + endpoint
+
+	// Build the complete URL
+	log.Info("full URL", "url", completeEndpoint)
+
+	// marshall the body
+	jsonData, err := json.Marshal(body)
 	if err != nil {
-		log.Error("Error creating request:", "error", err)
+		log.Error("error marshalling JSON", "error", err)
 		return err
 	}
 
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	// Create and set the "Authorization" header with the Base64-encoded client ID and client secret
-	authString := clientID + ":" + clientSecret
-	authHeader := "Basic " + base64.StdEncoding.EncodeToString([]byte(authString))
-	req.Header.Set("Authorization", authHeader)
-
-	// Create an HTTP client and make the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := doRequest(userId, "POST", completeEndpoint, jsonData)
 	if err != nil {
-		log.Error("Error making request:", "error", err)
 		return err
 	}
 	defer resp.Body.Close()
 
-	// Check the response
-	if resp.Status != "200 OK" {
-		log.Error("Error: HTTP Status", "status", resp.Status)
-		return errors.New("unsuccessful http request")
+	// Check the response status code
+	if resp.StatusCode != http.StatusCreated {
+		log.Warn("failed", "error code", resp.StatusCode)
 	}
 
-	log.Info("response", "status", resp.Status)
-
-	return json.NewDecoder(resp.Body).Decode(&authData)
+	// Decode the JSON response into the map
+	return json.NewDecoder(resp.Body).Decode(&data)
 }
 
-func Get[T any](data *T, endpoint string, params map[string]string) error {
-	// Get the access token
-	authData, err := GetAuth()
-	if err != nil {
-		log.Error("Error loading config", "error", err)
-		return err
-	}
+func Put[T any, B any](userId string, data *T, endpoint string, body *B) error {
 	// Create the full endpoint
 	completeEndpoint := SPOTIFY_API_URL + endpoint
 
-	// Create a map of query parameters
-	queryParams := url.Values{}
-
-	for key, value := range params {
-		queryParams.Add(key, value)
-	}
-
-	// Encode the query parameters into a URL-encoded string
-	query := queryParams.Encode()
-
-	// Build the complete URL with query parameters
-	fullURL := fmt.Sprintf("%s?%s", completeEndpoint, query)
-	log.Info("full URL", "url", fullURL)
+	// Build the complete URL
+	log.Info("full URL", "url", completeEndpoint)
 
-	req, err := http.NewRequest("GET", fullURL, nil)
+	// marshall the body
+	jsonData, err := json.Marshal(body)
 	if err != nil {
+		log.Error("error marshalling JSON", "error", err)
 		return err
 	}
 
-	// Set the User-Agent header
-	req.Header.Set("Authorization", "Bearer "+authData.AccessToken)
-
-	// Make the HTTP request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := doRequest(userId, "PUT", completeEndpoint, jsonData)
 	if err != nil {
-		log.Error("Error making the request:", err)
 		return err
 	}
 	defer resp.Body.Close()
 
 	// Check the response status code
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
 		log.Warn("failed", "error code", resp.StatusCode)
-		errorMessage := fmt.Sprintf("request failed with code: %d", resp.StatusCode)
-		return errors.New(errorMessage)
+		return &StatusError{StatusCode: resp.StatusCode}
 	}
 
 	// Decode the JSON response into the map
 	return json.NewDecoder(resp.Body).Decode(&data)
 }
 
-func Post[T any, B any](data *T, endpoint string, body *B) error {
-	// Get the access token
-	authData, err := GetAuth()
-	if err != nil {
-		log.Error("Error loading config", "error", err)
-		return err
-	}
+func Delete[T any, B any](userId string, data *T, endpoint string, body *B) error {
 	// Create the full endpoint
 	completeEndpoint := SPOTIFY_API_URL + endpoint
 
@@ -226,69 +223,247 @@ func Post[T any, B any](data *T, endpoint string, body *B) error {
 		return err
 	}
 
-	req, err := http.NewRequest("POST", completeEndpoint, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return err
-	}
-
-	// Set the User-Agent header
-	req.Header.Set("Authorization", "Bearer "+authData.AccessToken)
-	req.Header.Set("Content-Type", "application/json")
-
-	// Make the HTTP request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := doRequest(userId, "DELETE", completeEndpoint, jsonData)
 	if err != nil {
-		log.Error("Error making the request:", err)
 		return err
 	}
 	defer resp.Body.Close()
 
 	// Check the response status code
-	if resp.StatusCode != http.StatusCreated {
+	if resp.StatusCode != http.StatusOK {
 		log.Warn("failed", "error code", resp.StatusCode)
+		return &StatusError{StatusCode: resp.StatusCode}
 	}
 
 	// Decode the JSON response into the map
 	return json.NewDecoder(resp.Body).Decode(&data)
 }
 
-// Add spotify tracks to a spotify playlist
-func AddItemsToPlaylist(playlistId string, trackIds []string) (*AddPlaylistTracksReturnData, error) {
+// Add spotify tracks to a spotify playlist.
+// Tracks are sent in batches as spotify limits how many can be added per request
+func AddItemsToPlaylist(userId string, playlistId string, trackIds []string) (*AddPlaylistTracksReturnData, error) {
 	var playlistSnapshot AddPlaylistTracksReturnData
 
-	formattedTracks := make([]string, len(trackIds))
-	for i, v := range trackIds {
-		formattedTracks[i] = "spotify:track:" + v
+	url := fmt.Sprintf("/playlists/%s/tracks", playlistId)
+	for start := 0; start < len(trackIds); start += PLAYLIST_ITEMS_LIMIT {
+		end := min(start+PLAYLIST_ITEMS_LIMIT, len(trackIds))
+
+		formattedTracks := make([]string, 0, end-start)
+		for _, v := range trackIds[start:end] {
+			formattedTracks = append(formattedTracks, "spotify:track:"+v)
+		}
+
+		body := AddPlaylistTracksInputData{
+			Uris: formattedTracks,
+		}
+		err := Post(userId, &playlistSnapshot, url, &body)
+		if err != nil {
+			return &playlistSnapshot, err
+		}
+	}
+
+	return &playlistSnapshot, nil
+}
+
+// Replace all the tracks in a spotify playlist with the given tracks.
+// Only the first batch can be replaced in one request, so any remaining tracks are added afterwards
+func ReplacePlaylistItems(userId string, playlistId string, trackIds []string) (*AddPlaylistTracksReturnData, error) {
+	var playlistSnapshot AddPlaylistTracksReturnData
+
+	end := min(PLAYLIST_ITEMS_LIMIT, len(trackIds))
+	formattedTracks := make([]string, 0, end)
+	for _, v := range trackIds[:end] {
+		formattedTracks = append(formattedTracks, "spotify:track:"+v)
 	}
 
 	url := fmt.Sprintf("/playlists/%s/tracks", playlistId)
-	body := AddPlaylistTracksInputData{
+	body := ReplacePlaylistTracksInputData{
 		Uris: formattedTracks,
 	}
-	err := Post(&playlistSnapshot, url, &body)
+	err := Put(userId, &playlistSnapshot, url, &body)
+	if err != nil || end == len(trackIds) {
+		return &playlistSnapshot, err
+	}
+
+	return AddItemsToPlaylist(userId, playlistId, trackIds[end:])
+}
+
+// Remove spotify tracks from a spotify playlist.
+// Tracks are sent in batches as spotify limits how many can be removed per request
+func RemoveItemsFromPlaylist(userId string, playlistId string, trackIds []string) (*RemovePlaylistTracksReturnData, error) {
+	var playlistSnapshot RemovePlaylistTracksReturnData
+
+	url := fmt.Sprintf("/playlists/%s/tracks", playlistId)
+	for start := 0; start < len(trackIds); start += PLAYLIST_ITEMS_LIMIT {
+		end := min(start+PLAYLIST_ITEMS_LIMIT, len(trackIds))
+
+		var body RemovePlaylistTracksInputData
+		for _, v := range trackIds[start:end] {
+			body.Tracks = append(body.Tracks, PlaylistTrackUri{Uri: "spotify:track:" + v})
+		}
+
+		err := Delete(userId, &playlistSnapshot, url, &body)
+		if err != nil {
+			return &playlistSnapshot, err
+		}
+	}
+
+	return &playlistSnapshot, nil
+}
+
+// Get every track currently in a spotify playlist.
+// This will page through the playlist as spotify only returns a limited number of tracks per request
+func GetPlaylistTracks(userId string, playlistId string) (*PlaylistTracks, error) {
+	var playlistTracks PlaylistTracks
+
+	url := fmt.Sprintf("/playlists/%s/tracks", playlistId)
+	for {
+		var page PlaylistTracks
+		err := Get(userId, &page, url, map[string]string{
+			"limit":  "100",
+			"offset": strconv.Itoa(len(playlistTracks.Items)),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		playlistTracks.Total = page.Total
+		playlistTracks.Items = append(playlistTracks.Items, page.Items...)
+		if page.Next == "" || len(page.Items) == 0 {
+			break
+		}
+	}
 
-	return &playlistSnapshot, err
+	return &playlistTracks, nil
 }
 
-// Create a spotify playlist for the given user with the given name
-func CreatePlaylist(userId string, name string) (*CreatePlaylistReturnData, error) {
+// Get the tracks the user has saved to their liked songs since the given time.
+// Spotify returns the most recently saved tracks first, so paging stops once it reaches older tracks
+func GetSavedTracksSince(userId string, since time.Time) (*PlaylistTracks, error) {
+	var savedTracks PlaylistTracks
+
+	offset := 0
+	for {
+		var page PlaylistTracks
+		err := Get(userId, &page, "/me/tracks", map[string]string{
+			"limit":  "50",
+			"offset": strconv.Itoa(offset),
+		})
+		if err != nil {
+			return nil, err
+		}
+		offset += len(page.Items)
+
+		for _, v := range page.Items {
+			addedAt, err := time.Parse(time.RFC3339, v.AddedAt)
+			if err == nil && addedAt.Before(since) {
+				return &savedTracks, nil
+			}
+			savedTracks.Items = append(savedTracks.Items, v)
+		}
+		if page.Next == "" || len(page.Items) == 0 {
+			break
+		}
+	}
+
+	return &savedTracks, nil
+}
+
+// Get the tracks the user has played since the given time.
+// Spotify only keeps the user's 50 most recent plays, so anything older than that is lost
+func GetRecentlyPlayed(userId string, after time.Time) (*RecentlyPlayed, error) {
+	var recentlyPlayed RecentlyPlayed
+
+	err := Get(userId, &recentlyPlayed, "/me/player/recently-played", map[string]string{
+		"limit": "50",
+		"after": strconv.FormatInt(after.UnixMilli(), 10),
+	})
+
+	return &recentlyPlayed, err
+}
+
+// Create a spotify playlist for the given spotify user with the given name
+func CreatePlaylist(userId string, spotifyUserId string, name string) (*CreatePlaylistReturnData, error) {
 	var playlistData CreatePlaylistReturnData
 
-	url := fmt.Sprintf("/users/%s/playlists", userId)
+	url := fmt.Sprintf("/users/%s/playlists", spotifyUserId)
 	body := CreatePlaylistInputData{
 		Name: name,
 	}
-	err := Post(&playlistData, url, &body)
+	err := Post(userId, &playlistData, url, &body)
+
+	return &playlistData, err
+}
+
+// Create a collaborative spotify playlist for the given spotify user, so it can be shared with and edited by others.
+// Spotify requires collaborative playlists to be private
+func CreateCollaborativePlaylist(userId string, spotifyUserId string, name string, description string) (*CreatePlaylistReturnData, error) {
+	var playlistData CreatePlaylistReturnData
+
+	public := false
+	collaborative := true
+	url := fmt.Sprintf("/users/%s/playlists", spotifyUserId)
+	body := CreatePlaylistInputData{
+		Name:          name,
+		Description:   &description,
+		Public:        &public,
+		Collaborative: &collaborative,
+	}
+	err := Post(userId, &playlistData, url, &body)
 
 	return &playlistData, err
 }
 
-// Get the user data for the currently authenticated spotify user
-func GetUser() (*User, error) {
+// Replace a playlist's cover image with the given JPEG.
+// Spotify expects the image base64 encoded, and processes it in the background after accepting it
+func UploadPlaylistCover(userId string, playlistId string, jpegData []byte) error {
+	completeEndpoint := fmt.Sprintf("%s/playlists/%s/images", SPOTIFY_API_URL, playlistId)
+	log.Info("full URL", "url", completeEndpoint)
+
+	body := []byte(base64.StdEncoding.EncodeToString(jpegData))
+	resp, err := doRequestWithContentType(userId, "PUT", completeEndpoint, body, "image/jpeg")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		log.Warn("failed", "error code", resp.StatusCode)
+		return &StatusError{StatusCode: resp.StatusCode}
+	}
+
+	return nil
+}
+
+// Get the spotify user data for the given user
+func GetUser(userId string) (*User, error) {
 	var userData User
 
-	err := Get(&userData, "/me", nil)
+	err := Get(userId, &userData, "/me", nil)
 
 	return &userData, err
 }
+
+// Get an artist's most popular tracks on spotify in the given market
+func GetArtistTopTracks(userId string, artistId string, market string) (*ArtistTopTracks, error) {
+	var topTracksData ArtistTopTracks
+
+	url := fmt.Sprintf("/artists/%s/top-tracks", artistId)
+	err := Get(userId, &topTracksData, url, map[string]string{
+		"market": market,
+	})
+
+	return &topTracksData, err
+}
+
+// Check the user's stored tokens are still valid by fetching their spotify user
+func CheckAuth(userId string) (*User, error) {
+	userData, err := GetUser(userId)
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusUnauthorized {
+		return nil, fmt.Errorf("%w: access token rejected", ErrReauthRequired)
+	}
+
+	return userData, err
+}
@@ -502,9 +502,10 @@ type CreatePlaylistReturnData struct {
 }
 
 type CreatePlaylistInputData struct {
-	Name        string  `json:"name"`
-	Description *string `json:"description"`
-	Public      *bool   `json:"public"`
+	Name          string  `json:"name"`
+	Description   *string `json:"description"`
+	Public        *bool   `json:"public"`
+	Collaborative *bool   `json:"collaborative,omitempty"`
 }
 
 type AddPlaylistTracksReturnData struct {
@@ -515,3 +516,99 @@ type AddPlaylistTracksInputData struct {
 	Uris     []string `json:"uris"`
 	Position *int     `json:"position"`
 }
+
+type RemovePlaylistTracksReturnData struct {
+	SnapshotID string `json:"snapshot_id"`
+}
+
+type PlaylistTrackUri struct {
+	Uri string `json:"uri"`
+}
+
+type RemovePlaylistTracksInputData struct {
+	Tracks     []PlaylistTrackUri `json:"tracks"`
+	SnapshotID *string            `json:"snapshot_id,omitempty"`
+}
+
+type PlaylistTracks struct {
+	Href     string `json:"href"`
+	Limit    int    `json:"limit"`
+	Next     string `json:"next"`
+	Offset   int    `json:"offset"`
+	Previous string `json:"previous"`
+	Total    int    `json:"total"`
+	Items    []struct {
+		AddedAt string `json:"added_at"`
+		IsLocal bool   `json:"is_local"`
+		Track   struct {
+			Album struct {
+				ID     string `json:"id"`
+				Name   string `json:"name"`
+				Images []struct {
+					URL    string `json:"url"`
+					Height int    `json:"height"`
+					Width  int    `json:"width"`
+				} `json:"images"`
+			} `json:"album"`
+			Artists []struct {
+				ID   string `json:"id"`
+				Name string `json:"name"`
+			} `json:"artists"`
+			ID   string `json:"id"`
+			Name string `json:"name"`
+			URI  string `json:"uri"`
+		} `json:"track"`
+	} `json:"items"`
+}
+
+type ArtistTopTracks struct {
+	Tracks []struct {
+		Album struct {
+			ID     string `json:"id"`
+			Name   string `json:"name"`
+			Images []struct {
+				URL    string `json:"url"`
+				Height int    `json:"height"`
+				Width  int    `json:"width"`
+			} `json:"images"`
+		} `json:"album"`
+		Artists []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"artists"`
+		ID         string `json:"id"`
+		Name       string `json:"name"`
+		Popularity int    `json:"popularity"`
+		URI        string `json:"uri"`
+	} `json:"tracks"`
+}
+
+type ReplacePlaylistTracksInputData struct {
+	Uris []string `json:"uris"`
+}
+
+type RecentlyPlayed struct {
+	Href  string `json:"href"`
+	Limit int    `json:"limit"`
+	Next  string `json:"next"`
+	Items []struct {
+		PlayedAt string `json:"played_at"`
+		Track    struct {
+			Album struct {
+				Name string `json:"name"`
+			} `json:"album"`
+			Artists []struct {
+				ID   string `json:"id"`
+				Name string `json:"name"`
+			} `json:"artists"`
+			DurationMs int    `json:"duration_ms"`
+			ID         string `json:"id"`
+			Name       string `json:"name"`
+			URI        string `json:"uri"`
+		} `json:"track"`
+	} `json:"items"`
+	Cursors struct {
+		After  string `json:"after"`
+		Before string `json:"before"`
+	} `json:"cursors"`
+}
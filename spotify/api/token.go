@@ -0,0 +1,246 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"example/lastfm-spotify-syncer/config"
+	"example/lastfm-spotify-syncer/metrics"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const SPOTIFY_TOKEN_URL = "https://accounts.spotify.com/api/token"
+
+// Refresh the access token this long before it actually expires, so it can't expire mid request
+const TOKEN_EXPIRY_SKEW = 2 * time.Minute
+
+// Held while checking or refreshing the access token, so only one refresh happens at a time
+var tokenLock sync.Mutex
+
+// Returned when spotify will no longer refresh the access token, e.g. because the user revoked access to the app.
+// The user needs to authorize with spotify again
+var ErrReauthRequired = errors.New("spotify re-authorization required")
+
+// The body spotify returns when a token request fails
+type tokenErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// The response from the spotify token endpoint when refreshing.
+// Spotify may or may not include a new refresh token
+type refreshTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	Scope        string `json:"scope"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Get a user's spotify auth data with a valid access token, refreshing it first if it is about to expire
+func GetAuth(userId string) (*config.SpotifyAuthData, error) {
+	tokenLock.Lock()
+	defer tokenLock.Unlock()
+
+	conf, err := config.LoadConfig(false)
+	if err != nil {
+		log.Error("Error fetching config", "error", err)
+		return nil, err
+	}
+	user := conf.GetUser(userId)
+	if user == nil {
+		return nil, fmt.Errorf("no user with id %s", userId)
+	}
+
+	// No need to refresh the token if it isn't close to expiring
+	if time.Now().Add(TOKEN_EXPIRY_SKEW).Before(user.Spotify.ExpiresAt) {
+		authData := user.Spotify
+		return &authData, nil
+	}
+
+	return refreshAndSave(conf, user)
+}
+
+// Refresh the access token even though it hasn't expired, e.g. because spotify rejected it.
+// The token that was rejected is passed in, so if another request has already refreshed it in the meantime
+// the new token is used rather than refreshing again
+func forceRefresh(userId string, rejectedToken string) (*config.SpotifyAuthData, error) {
+	tokenLock.Lock()
+	defer tokenLock.Unlock()
+
+	conf, err := config.LoadConfig(false)
+	if err != nil {
+		log.Error("Error fetching config", "error", err)
+		return nil, err
+	}
+	user := conf.GetUser(userId)
+	if user == nil {
+		return nil, fmt.Errorf("no user with id %s", userId)
+	}
+
+	if user.Spotify.AccessToken != rejectedToken {
+		authData := user.Spotify
+		return &authData, nil
+	}
+
+	return refreshAndSave(conf, user)
+}
+
+// Refresh a user's access token and persist the new tokens.
+// tokenLock must be held
+func refreshAndSave(conf *config.Config, user *config.User) (*config.SpotifyAuthData, error) {
+	authData := user.Spotify
+	err := refreshToken(conf.Auth.Spotify, &authData)
+	metrics.TokenRefresh(err)
+	if err != nil {
+		log.Error("Error refreshing token", "error", err)
+		return nil, err
+	}
+
+	// Only swap in the new tokens once the refresh has fully succeeded, so the access and refresh
+	// tokens are never out of step with each other
+	err = config.Update(func(conf *config.Config) error {
+		current := conf.GetUser(user.Id)
+		if current == nil {
+			return fmt.Errorf("no user with id %s", user.Id)
+		}
+		current.Spotify = authData
+		return nil
+	})
+	if err != nil {
+		log.Error("Error saving refreshed token", "error", err)
+		return nil, err
+	}
+
+	return &authData, nil
+}
+
+func refreshToken(app config.SpotifyAppData, authData *config.SpotifyAuthData) error {
+	clientID := app.ClientId
+	clientSecret := app.ClientSecret
+
+	// Create a URL-encoded request body
+	data := url.Values{}
+	data.Set("grant_type", "refresh_token")
+	data.Set("refresh_token", authData.RefreshToken)
+	// Tokens issued with PKCE are refreshed with the client id rather than the client secret
+	if authData.Pkce {
+		data.Set("client_id", clientID)
+	}
+
+	// Create an HTTP request with the request body
+	payload := strings.NewReader(data.Encode())
+	req, err := http.NewRequest("POST", SPOTIFY_TOKEN_URL, payload)
+	if err != nil {
+		log.Error("Error creating request:", "error", err)
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if !authData.Pkce {
+		// Create and set the "Authorization" header with the Base64-encoded client ID and client secret
+		authString := clientID + ":" + clientSecret
+		authHeader := "Basic " + base64.StdEncoding.EncodeToString([]byte(authString))
+		req.Header.Set("Authorization", authHeader)
+	}
+
+	// Create an HTTP client and make the request
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Error("Error making request:", "error", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Check the response
+	if resp.StatusCode != http.StatusOK {
+		var errorData tokenErrorResponse
+		json.NewDecoder(resp.Body).Decode(&errorData)
+		log.Error("Error: HTTP Status", "status", resp.Status, "error", errorData.Error, "description", errorData.ErrorDescription)
+
+		// invalid_grant means the refresh token has been revoked, invalid_client that the client credentials are wrong
+		if errorData.Error == "invalid_grant" || errorData.Error == "invalid_client" {
+			return fmt.Errorf("%w: %s", ErrReauthRequired, errorData.ErrorDescription)
+		}
+		return errors.New("unsuccessful http request")
+	}
+
+	var tokenData refreshTokenResponse
+	err = json.NewDecoder(resp.Body).Decode(&tokenData)
+	if err != nil {
+		log.Error("Error decoding refresh response", "error", err)
+		return err
+	}
+	if tokenData.AccessToken == "" {
+		return errors.New("no access token in refresh response")
+	}
+
+	authData.AccessToken = tokenData.AccessToken
+	authData.ExpiresIn = tokenData.ExpiresIn
+	authData.ExpiresAt = time.Now().Add(time.Duration(tokenData.ExpiresIn) * time.Second)
+	if tokenData.RefreshToken != "" && tokenData.RefreshToken != authData.RefreshToken {
+		log.Info("Spotify rotated the refresh token")
+		authData.RefreshToken = tokenData.RefreshToken
+	}
+	log.Info("Refreshed spotify access token", "expires", authData.ExpiresAt)
+
+	return nil
+}
+
+// Send a JSON request to the spotify api using the user's current access token.
+// If spotify rejects the token, it is refreshed and the request is retried once
+func doRequest(userId string, method string, fullURL string, body []byte) (*http.Response, error) {
+	return doRequestWithContentType(userId, method, fullURL, body, "application/json")
+}
+
+// Send a request with a body of the given content type to the spotify api, as doRequest
+func doRequestWithContentType(userId string, method string, fullURL string, body []byte, contentType string) (*http.Response, error) {
+	authData, err := GetAuth(userId)
+	if err != nil {
+		log.Error("Error loading config", "error", err)
+		return nil, err
+	}
+
+	client := &http.Client{}
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, fullURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Authorization", "Bearer "+authData.AccessToken)
+		if body != nil {
+			req.Header.Set("Content-Type", contentType)
+		}
+
+		// Make the HTTP request
+		startedAt := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			metrics.ObserveSpotifyRequest(endpointLabel(req.URL.Path), method, metrics.STATUS_ERROR, time.Since(startedAt))
+			log.Error("Error making the request:", "error", err)
+			return nil, err
+		}
+		metrics.ObserveSpotifyRequest(endpointLabel(req.URL.Path), method, metrics.Status(resp.StatusCode), time.Since(startedAt))
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		log.Warn("Spotify rejected the access token, refreshing and retrying", "url", fullURL)
+		metrics.Retry("spotify", "unauthorized")
+		authData, err = forceRefresh(userId, authData.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package sync
+
+import (
+	"example/lastfm-spotify-syncer/config"
+	lastFmApi "example/lastfm-spotify-syncer/lastfm/api"
+	spotifyApi "example/lastfm-spotify-syncer/spotify/api"
+	"fmt"
+	"strings"
+
+	"github.com/charmbracelet/log"
+)
+
+const DEFAULT_ARTIST_COUNT = 20
+const DEFAULT_TRACKS_PER_ARTIST = 3
+
+// How many of the user's top tracks to look through when picking tracks for each artist from lastfm
+const ARTIST_TRACKS_SEARCH_LIMIT = 1000
+
+// Get the tracks to use for a top artists playlist.
+// The user's top artists for the period are fetched from lastfm, then tracks are picked for each artist
+// either from the user's own most played tracks or from spotify's top tracks for the artist
+func getTopArtistTracks(userId string, period string, periodConf config.Period, username string) ([]track, error) {
+	artistCount := periodConf.ArtistCount
+	if artistCount <= 0 {
+		artistCount = DEFAULT_ARTIST_COUNT
+	}
+	tracksPerArtist := periodConf.TracksPerArtist
+	if tracksPerArtist <= 0 {
+		tracksPerArtist = DEFAULT_TRACKS_PER_ARTIST
+	}
+
+	topArtistsData, err := lastFmApi.GetTopArtists(period, artistCount, username)
+	if err != nil {
+		log.Error("Unable to fetch top artists from last fm api", "error", err)
+		return nil, err
+	}
+
+	var artists []string
+	for _, v := range topArtistsData.Topartists.Artist {
+		artists = append(artists, v.Name)
+	}
+	log.Info("top artists", "artists", artists)
+
+	switch periodConf.ArtistTracks {
+	case config.ARTIST_TRACKS_SPOTIFY:
+		return getSpotifyArtistTracks(userId, artists, tracksPerArtist)
+	default:
+		return getLastFmArtistTracks(period, artists, tracksPerArtist, username)
+	}
+}
+
+// Pick the user's most played tracks by each artist over the period
+func getLastFmArtistTracks(period string, artists []string, tracksPerArtist int, username string) ([]track, error) {
+	topTracksData, err := lastFmApi.GetTopTracks(period, ARTIST_TRACKS_SEARCH_LIMIT, username)
+	if err != nil {
+		log.Error("Unable to fetch from last fm api", "error", err)
+		return nil, err
+	}
+
+	// Top tracks are already ordered by playcount, so the first tracks seen for an artist are their most played
+	tracksByArtist := make(map[string][]track)
+	for _, v := range topTracksData.Toptracks.Track {
+		key := strings.ToLower(v.Artist.Name)
+		if len(tracksByArtist[key]) < tracksPerArtist {
+			tracksByArtist[key] = append(tracksByArtist[key], track{Artist: v.Artist.Name, Name: v.Name, Image: largestImage(v.Image)})
+		}
+	}
+
+	var tracks []track
+	for _, artist := range artists {
+		tracks = append(tracks, tracksByArtist[strings.ToLower(artist)]...)
+	}
+
+	return tracks, nil
+}
+
+// Pick spotify's top tracks for each artist
+func getSpotifyArtistTracks(userId string, artists []string, tracksPerArtist int) ([]track, error) {
+	spotifyUserData, err := spotifyApi.GetUser(userId)
+	if err != nil {
+		log.Error("Unable to fetch from spotify api", "error", err)
+		return nil, err
+	}
+
+	var tracks []track
+	for _, artist := range artists {
+		var searchData spotifyApi.Search
+		searchQuery := transformStringForSpotify(fmt.Sprintf("artist: \"%s\"", artist))
+		err := spotifyApi.Get(userId, &searchData, "/search", map[string]string{
+			"q":     searchQuery,
+			"type":  "artist",
+			"limit": "1",
+		})
+		if err != nil {
+			log.Error("error searching spotify", "error", err)
+			continue
+		}
+		if len(searchData.Artists.Items) == 0 {
+			log.Warn("Spotify search returned no results for this artist", "artist", artist)
+			continue
+		}
+
+		topTracksData, err := spotifyApi.GetArtistTopTracks(userId, searchData.Artists.Items[0].ID, spotifyUserData.Country)
+		if err != nil {
+			log.Error("error fetching artist top tracks", "error", err)
+			continue
+		}
+
+		for i, v := range topTracksData.Tracks {
+			if i >= tracksPerArtist {
+				break
+			}
+			tracks = append(tracks, track{Artist: artist, Name: v.Name, SpotifyId: v.ID})
+		}
+	}
+
+	return tracks, nil
+}
@@ -0,0 +1,250 @@
+package sync
+
+import (
+	"errors"
+	"example/lastfm-spotify-syncer/config"
+	lastFmApi "example/lastfm-spotify-syncer/lastfm/api"
+	spotifyApi "example/lastfm-spotify-syncer/spotify/api"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// How many of each user's top tracks to blend. This is deeper than most playlists so intersections have something to find
+const BLEND_TOP_TRACKS_LIMIT = 500
+
+const DEFAULT_BLEND_MAX_TRACKS = 50
+
+// A track from a user's top tracks, along with how many times they played it
+type playedTrack struct {
+	track
+	Playcount int
+}
+
+// Sync a blend of several lastfm users' top tracks into a shared playlist in the owner's spotify account.
+// The outcome is recorded in the owner's history
+func SyncBlend(blendId string) error {
+	conf, err := config.LoadConfig(false)
+	if err != nil {
+		log.Error("Error loading config", "err", err)
+		return err
+	}
+	blendConf := conf.GetBlend(blendId)
+	if blendConf == nil {
+		log.Error("Invalid blend given", "blend", blendId)
+		return fmt.Errorf("no blend with id %s", blendId)
+	}
+	blend := *blendConf
+	if conf.GetUser(blend.OwnerId) == nil {
+		log.Error("Blend owner no longer exists", "blend", blend.Name, "owner", blend.OwnerId)
+		return fmt.Errorf("no user with id %s", blend.OwnerId)
+	}
+
+	startedAt := time.Now()
+	result, err := syncBlend(blend)
+	recordRun(blend.OwnerId, "blend", startedAt, result, err)
+
+	return err
+}
+
+func syncBlend(blend config.Blend) (*syncResult, error) {
+	if len(blend.Usernames) < 2 {
+		return nil, errors.New("a blend needs at least two users")
+	}
+	maxTracks := blend.MaxTracks
+	if maxTracks <= 0 {
+		maxTracks = DEFAULT_BLEND_MAX_TRACKS
+	}
+
+	topTracks := make([][]playedTrack, 0, len(blend.Usernames))
+	for _, username := range blend.Usernames {
+		tracks, err := getPlayedTopTracks(blend.Period, BLEND_TOP_TRACKS_LIMIT, username)
+		if err != nil {
+			return nil, err
+		}
+		topTracks = append(topTracks, tracks)
+	}
+
+	var tracks []track
+	switch blend.Strategy {
+	case config.BLEND_INTERSECTION:
+		tracks = intersectTracks(topTracks)
+	case config.BLEND_PLAYCOUNT:
+		weights := make([]float64, 0, len(blend.Usernames))
+		for _, username := range blend.Usernames {
+			weights = append(weights, blend.Weight(username))
+		}
+		tracks = combineByPlaycount(topTracks, weights)
+	default:
+		tracks = interleaveTracks(topTracks)
+	}
+	if len(tracks) > maxTracks {
+		tracks = tracks[:maxTracks]
+	}
+	log.Info("blended tracks", "blend", blend.Name, "strategy", blend.Strategy, "count", len(tracks))
+
+	trackIds := matchTracks(blend.OwnerId, tracks)
+	log.Info("track ids", "ids", trackIds)
+	playlistName := "LastFM Blend: " + blend.Name
+	result := &syncResult{PlaylistName: playlistName, Tracks: len(tracks), Matched: len(trackIds)}
+
+	playlistId, err := getOrCreateBlendPlaylist(blend, playlistName)
+	if err != nil {
+		log.Error("error finding blend playlist", "error", err)
+		return result, err
+	}
+	result.PlaylistId = playlistId
+
+	_, err = spotifyApi.ReplacePlaylistItems(blend.OwnerId, playlistId, trackIds)
+	if err != nil {
+		log.Error("error replacing playlist items", "error", err)
+		return result, err
+	}
+
+	log.Info("Blend playlist synced!")
+	return result, nil
+}
+
+// Get the blend's playlist, creating a collaborative playlist in the owner's account if it doesn't exist yet
+func getOrCreateBlendPlaylist(blend config.Blend, name string) (string, error) {
+	exists, err := playlistExists(blend.OwnerId, blend.PlaylistId)
+	if err != nil {
+		return "", err
+	} else if exists {
+		return blend.PlaylistId, nil
+	}
+
+	spotifyUserData, err := spotifyApi.GetUser(blend.OwnerId)
+	if err != nil {
+		log.Error("Unable to fetch from spotify api", "error", err)
+		return "", err
+	}
+
+	description := "The top tracks of " + strings.Join(blend.Usernames, ", ")
+	playlistData, err := spotifyApi.CreateCollaborativePlaylist(blend.OwnerId, spotifyUserData.ID, name, description)
+	if err != nil {
+		return "", err
+	}
+	log.Info("created playlist", "playlist", playlistData)
+
+	config.Update(func(conf *config.Config) error {
+		if b := conf.GetBlend(blend.Id); b != nil {
+			b.PlaylistId = playlistData.ID
+		}
+		return nil
+	})
+
+	return playlistData.ID, nil
+}
+
+// Get a user's top tracks for the period along with their playcounts
+func getPlayedTopTracks(period string, limit int, username string) ([]playedTrack, error) {
+	topTracksData, err := lastFmApi.GetTopTracks(period, limit, username)
+	if err != nil {
+		log.Error("Unable to fetch from last fm api", "error", err, "user", username)
+		return nil, err
+	}
+
+	var tracks []playedTrack
+	for _, v := range topTracksData.Toptracks.Track {
+		playcount, _ := strconv.Atoi(v.Playcount)
+		tracks = append(tracks, playedTrack{track: track{Artist: v.Artist.Name, Name: v.Name}, Playcount: playcount})
+	}
+
+	return tracks, nil
+}
+
+// Take each user's top track in turn, then each of their second tracks and so on, skipping tracks already taken
+func interleaveTracks(topTracks [][]playedTrack) []track {
+	seen := make(map[string]bool)
+	var tracks []track
+	for rank := 0; ; rank++ {
+		found := false
+		for _, userTracks := range topTracks {
+			if rank >= len(userTracks) {
+				continue
+			}
+			found = true
+
+			key := trackKey(userTracks[rank].track)
+			if !seen[key] {
+				seen[key] = true
+				tracks = append(tracks, userTracks[rank].track)
+			}
+		}
+		if !found {
+			break
+		}
+	}
+
+	return tracks
+}
+
+// Keep only the tracks every user has played, most played between them first
+func intersectTracks(topTracks [][]playedTrack) []track {
+	weights := make([]float64, len(topTracks))
+	for i := range weights {
+		weights[i] = 1
+	}
+	combined := combinePlaycounts(topTracks, weights)
+
+	var tracks []track
+	for _, v := range combined {
+		if v.Users == len(topTracks) {
+			tracks = append(tracks, v.track)
+		}
+	}
+
+	return tracks
+}
+
+// Order every track by each user's playcount multiplied by their weight, summed across users
+func combineByPlaycount(topTracks [][]playedTrack, weights []float64) []track {
+	var tracks []track
+	for _, v := range combinePlaycounts(topTracks, weights) {
+		tracks = append(tracks, v.track)
+	}
+
+	return tracks
+}
+
+// A track with its weighted playcount summed across users, and how many of the users played it
+type combinedTrack struct {
+	track
+	Score float64
+	Users int
+}
+
+// Sum the weighted playcounts of each track across users, returning the tracks with the highest score first
+func combinePlaycounts(topTracks [][]playedTrack, weights []float64) []combinedTrack {
+	var combined []combinedTrack
+	index := make(map[string]int)
+	for i, userTracks := range topTracks {
+		// Lastfm can list the same track more than once with different capitalisation, which shouldn't count as another user
+		counted := make(map[string]bool)
+		for _, v := range userTracks {
+			key := trackKey(v.track)
+			j, ok := index[key]
+			if !ok {
+				j = len(combined)
+				index[key] = j
+				combined = append(combined, combinedTrack{track: v.track})
+			}
+			combined[j].Score += float64(v.Playcount) * weights[i]
+			if !counted[key] {
+				counted[key] = true
+				combined[j].Users++
+			}
+		}
+	}
+
+	sort.SliceStable(combined, func(i, j int) bool {
+		return combined[i].Score > combined[j].Score
+	})
+
+	return combined
+}
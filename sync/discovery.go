@@ -0,0 +1,176 @@
+package sync
+
+import (
+	"example/lastfm-spotify-syncer/config"
+	lastFmApi "example/lastfm-spotify-syncer/lastfm/api"
+	spotifyApi "example/lastfm-spotify-syncer/spotify/api"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const DEFAULT_SEED_COUNT = 10
+const DEFAULT_DISCOVERY_MAX_TRACKS = 30
+
+// How many similar tracks and artists to fetch for each seed
+const SIMILAR_TRACKS_LIMIT = 50
+const SIMILAR_ARTISTS_LIMIT = 5
+
+// A track similar to one of the seeds, along with how similar lastfm thinks it is
+type candidate struct {
+	track
+	Match float64
+}
+
+// Sync a playlist of tracks similar to the user's top tracks that they haven't listened to before
+func syncDiscovery(user config.User) (*syncResult, error) {
+	discoveryConf := user.Sync.Discovery
+	username := user.LastFM.Username
+
+	seedPeriod := discoveryConf.SeedPeriod
+	if seedPeriod == "" {
+		seedPeriod = "weekly"
+	}
+	seedCount := discoveryConf.SeedCount
+	if seedCount <= 0 {
+		seedCount = DEFAULT_SEED_COUNT
+	}
+	maxTracks := discoveryConf.MaxTracks
+	if maxTracks <= 0 {
+		maxTracks = DEFAULT_DISCOVERY_MAX_TRACKS
+	}
+
+	seeds, err := getTopTracks(seedPeriod, seedCount, username)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := getDiscoveryCandidates(seeds, discoveryConf.MinSimilarity)
+	log.Info("discovery candidates", "count", len(candidates))
+
+	// Only keep the tracks the user has never scrobbled
+	var tracks []track
+	for _, v := range candidates {
+		if len(tracks) >= maxTracks {
+			break
+		}
+
+		trackInfo, err := lastFmApi.GetTrackInfo(v.Artist, v.Name, username)
+		if err != nil {
+			log.Error("error fetching track info", "error", err)
+			continue
+		}
+		if trackInfo.Track.Name == "" {
+			log.Warn("Lastfm returned no info for this track", "name", v.Name, "artist", v.Artist)
+			continue
+		}
+		playcount, _ := strconv.Atoi(trackInfo.Track.Userplaycount)
+		if playcount > 0 {
+			log.Debug("skipping already scrobbled track", "name", v.Name, "artist", v.Artist, "playcount", playcount)
+			continue
+		}
+		tracks = append(tracks, v.track)
+	}
+
+	spotifyUserData, err := spotifyApi.GetUser(user.Id)
+	if err != nil {
+		log.Error("Unable to fetch from spotify api", "error", err)
+		return nil, err
+	}
+
+	trackIds := matchTracks(user.Id, tracks)
+	log.Info("track ids", "ids", trackIds)
+
+	playlistName := fmt.Sprintf("LastFM Discovery: %s", time.Now().Format("Jan 02 2006"))
+	result := &syncResult{PlaylistName: playlistName, Tracks: len(tracks), Matched: len(trackIds)}
+	playlistData, err := spotifyApi.CreatePlaylist(user.Id, spotifyUserData.ID, playlistName)
+	if err != nil {
+		log.Error("error creating playlist", "error", err)
+		return result, err
+	}
+	log.Info("created playlist", "playlist", playlistData)
+	result.PlaylistId = playlistData.ID
+
+	_, err = spotifyApi.AddItemsToPlaylist(user.Id, playlistData.ID, trackIds)
+	if err != nil {
+		log.Error("error adding items to playlist playlist", "error", err)
+		return result, err
+	}
+
+	log.Info("Populated discovery playlist!")
+	return result, nil
+}
+
+// Expand the seed tracks into similar tracks, using both the similar tracks for each seed
+// and the top track of each similar artist.
+// Candidates are returned with the most similar first, with the seeds themselves and duplicates removed
+func getDiscoveryCandidates(seeds []track, minSimilarity float64) []candidate {
+	seen := make(map[string]bool)
+	for _, v := range seeds {
+		seen[trackKey(v)] = true
+	}
+
+	var candidates []candidate
+	addCandidate := func(c candidate) {
+		key := trackKey(c.track)
+		if c.Match < minSimilarity || seen[key] {
+			return
+		}
+		seen[key] = true
+		candidates = append(candidates, c)
+	}
+
+	seenArtists := make(map[string]bool)
+	for _, seed := range seeds {
+		similarTracksData, err := lastFmApi.GetSimilarTracks(seed.Artist, seed.Name, SIMILAR_TRACKS_LIMIT)
+		if err != nil {
+			log.Error("error fetching similar tracks", "error", err)
+		} else {
+			for _, v := range similarTracksData.Similartracks.Track {
+				addCandidate(candidate{track: track{Artist: v.Artist.Name, Name: v.Name}, Match: v.Match})
+			}
+		}
+
+		artistKey := strings.ToLower(seed.Artist)
+		if seenArtists[artistKey] {
+			continue
+		}
+		seenArtists[artistKey] = true
+
+		similarArtistsData, err := lastFmApi.GetSimilarArtists(seed.Artist, SIMILAR_ARTISTS_LIMIT)
+		if err != nil {
+			log.Error("error fetching similar artists", "error", err)
+			continue
+		}
+		for _, artist := range similarArtistsData.Similarartists.Artist {
+			match, _ := strconv.ParseFloat(artist.Match, 64)
+			if match < minSimilarity {
+				continue
+			}
+
+			topTracksData, err := lastFmApi.GetArtistTopTracks(artist.Name, 1)
+			if err != nil {
+				log.Error("error fetching artist top tracks", "error", err)
+				continue
+			}
+			for _, v := range topTracksData.Toptracks.Track {
+				addCandidate(candidate{track: track{Artist: v.Artist.Name, Name: v.Name}, Match: match})
+			}
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Match > candidates[j].Match
+	})
+
+	return candidates
+}
+
+// A key to compare tracks by, ignoring case
+func trackKey(t track) string {
+	return strings.ToLower(t.Artist) + "\x00" + strings.ToLower(t.Name)
+}
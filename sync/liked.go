@@ -0,0 +1,195 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"example/lastfm-spotify-syncer/config"
+	lastFmApi "example/lastfm-spotify-syncer/lastfm/api"
+	spotifyApi "example/lastfm-spotify-syncer/spotify/api"
+	"os"
+	gosync "sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// How far back to look for saved tracks the first time the liked sync runs
+const DEFAULT_LIKED_LOOKBACK = 7 * 24 * time.Hour
+
+// How many of the user's loved tracks to check before loving a track, so tracks loved outside the app aren't loved again
+const LOVED_DIFF_LIMIT = 1000
+
+// Guards the loved state file, which is shared by every user's liked syncs
+var lovedStateLock gosync.Mutex
+
+// Records the tracks each user has had loved on lastfm by the liked sync, so nothing is loved twice.
+// Keyed by user id, then trackKey
+type lovedState map[string]map[string]time.Time
+
+// Read the loved state for every user. lovedStateLock must be held
+func readLovedState() lovedState {
+	state := make(lovedState)
+
+	data, err := os.ReadFile(config.LovedStateFilename())
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Warn("Unable to read loved state, starting with an empty one", "error", err)
+		}
+		return state
+	}
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		log.Warn("Unable to parse loved state, starting with an empty one", "error", err)
+	}
+
+	return state
+}
+
+// Get the tracks the liked sync has loved for the user, keyed by trackKey
+func loadLovedTracks(userId string) map[string]time.Time {
+	lovedStateLock.Lock()
+	defer lovedStateLock.Unlock()
+
+	tracks := readLovedState()[userId]
+	if tracks == nil {
+		tracks = make(map[string]time.Time)
+	}
+
+	return tracks
+}
+
+// Record tracks the liked sync has loved for the user, along with any recorded by other syncs since they were loaded
+func saveLovedTracks(userId string, tracks map[string]time.Time) error {
+	lovedStateLock.Lock()
+	defer lovedStateLock.Unlock()
+
+	state := readLovedState()
+	if state[userId] == nil {
+		state[userId] = make(map[string]time.Time)
+	}
+	for key, lovedAt := range tracks {
+		state[userId][key] = lovedAt
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		log.Error("Error encoding loved state", "error", err)
+		return err
+	}
+	err = config.WriteFileAtomic(config.LovedStateFilename(), data)
+	if err != nil {
+		log.Error("Error writing loved state", "error", err)
+		return err
+	}
+
+	return nil
+}
+
+// Love the tracks the user has saved on spotify since the last sync on lastfm.
+// Tracks are taken from either the user's liked songs or a chosen playlist. Tracks that are already loved,
+// or that this sync has loved before, are skipped
+func syncLiked(user config.User) (*syncResult, error) {
+	likedConf := user.Sync.Liked
+	startedAt := time.Now()
+	since := likedConf.LastSyncedAt
+	if since.IsZero() {
+		since = startedAt.Add(-DEFAULT_LIKED_LOOKBACK)
+	}
+
+	var savedTracks *spotifyApi.PlaylistTracks
+	var err error
+	switch likedConf.Source {
+	case config.LIKED_SOURCE_PLAYLIST:
+		if likedConf.PlaylistId == "" {
+			return nil, errors.New("no playlist set for the liked sync")
+		}
+		savedTracks, err = spotifyApi.GetPlaylistTracks(user.Id, likedConf.PlaylistId)
+	default:
+		savedTracks, err = spotifyApi.GetSavedTracksSince(user.Id, since)
+	}
+	if err != nil {
+		log.Error("Unable to fetch saved tracks from spotify api", "error", err)
+		return nil, err
+	}
+
+	var tracks []track
+	for _, v := range savedTracks.Items {
+		addedAt, err := time.Parse(time.RFC3339, v.AddedAt)
+		if err == nil && addedAt.Before(since) {
+			continue
+		}
+		if len(v.Track.Artists) == 0 || v.Track.Name == "" {
+			continue
+		}
+		tracks = append(tracks, track{Artist: v.Track.Artists[0].Name, Name: v.Track.Name, SpotifyId: v.Track.ID})
+	}
+	log.Info("tracks saved since last sync", "count", len(tracks), "since", since)
+	result := &syncResult{Tracks: len(tracks)}
+
+	if len(tracks) > 0 {
+		loved, err := lovePendingTracks(user, tracks)
+		result.Matched = loved
+		if err != nil {
+			return result, err
+		}
+	}
+
+	updateUser(user.Id, func(u *config.User) {
+		u.Sync.Liked.LastSyncedAt = startedAt
+	})
+
+	log.Info("Liked tracks synced!", "loved", result.Matched)
+	return result, nil
+}
+
+// Love each track on lastfm unless it is already loved, returning how many were loved.
+// What was loved is saved even if it stops part way through, so the next sync doesn't love the same tracks again
+func lovePendingTracks(user config.User, tracks []track) (int, error) {
+	lovedTracksData, err := lastFmApi.GetLovedTracks(LOVED_DIFF_LIMIT, user.LastFM.Username)
+	if err != nil {
+		log.Error("Unable to fetch from last fm api", "error", err)
+		return 0, err
+	}
+	alreadyLoved := make(map[string]bool)
+	for _, v := range lovedTracksData.Lovedtracks.Track {
+		alreadyLoved[trackKey(track{Artist: v.Artist.Name, Name: v.Name})] = true
+	}
+
+	lovedByApp := loadLovedTracks(user.Id)
+
+	loved := 0
+	var loveErr error
+	for _, t := range tracks {
+		key := trackKey(t)
+		if alreadyLoved[key] {
+			continue
+		}
+		if _, ok := lovedByApp[key]; ok {
+			log.Debug("skipping track that has been loved before", "name", t.Name, "artist", t.Artist)
+			continue
+		}
+
+		err := lastFmApi.LoveTrack(user.LastFM.Token, t.Artist, t.Name)
+		if err != nil {
+			log.Error("error loving track", "name", t.Name, "artist", t.Artist, "error", err)
+			if lastFmApi.IsReauthRequired(err) {
+				loveErr = err
+				break
+			}
+			continue
+		}
+		log.Info("loved track", "name", t.Name, "artist", t.Artist)
+		lovedByApp[key] = time.Now()
+		alreadyLoved[key] = true
+		loved++
+	}
+
+	err = saveLovedTracks(user.Id, lovedByApp)
+	if loveErr != nil {
+		return loved, loveErr
+	}
+	if err != nil {
+		return loved, err
+	}
+
+	return loved, nil
+}
@@ -0,0 +1,109 @@
+package sync
+
+import (
+	"example/lastfm-spotify-syncer/config"
+	lastFmApi "example/lastfm-spotify-syncer/lastfm/api"
+	spotifyApi "example/lastfm-spotify-syncer/spotify/api"
+	"strconv"
+
+	"github.com/charmbracelet/log"
+)
+
+const LOVED_PLAYLIST_NAME = "Last.fm Loved"
+
+const DEFAULT_LOVED_MAX_TRACKS = 500
+
+// Sync the user's lastfm loved tracks into a single spotify playlist.
+// Unlike the period syncs, the same playlist is reused each time; newly loved tracks are added to it
+// and, if enabled, tracks that are no longer loved are removed from it
+func syncLoved(user config.User) (*syncResult, error) {
+	lovedConf := user.Sync.Loved
+	maxTracks := lovedConf.MaxTracks
+	if maxTracks <= 0 {
+		maxTracks = DEFAULT_LOVED_MAX_TRACKS
+	}
+
+	lovedTracksData, err := lastFmApi.GetLovedTracks(maxTracks, user.LastFM.Username)
+	if err != nil {
+		log.Error("Unable to fetch from last fm api", "error", err)
+		return nil, err
+	}
+
+	var tracks []track
+	for _, v := range lovedTracksData.Lovedtracks.Track {
+		tracks = append(tracks, track{Artist: v.Artist.Name, Name: v.Name})
+	}
+	trackIds := matchTracks(user.Id, tracks)
+	log.Debug("track ids", "ids", trackIds)
+	result := &syncResult{PlaylistName: LOVED_PLAYLIST_NAME, Tracks: len(tracks), Matched: len(trackIds)}
+
+	playlistId, err := getOrCreatePlaylist(user.Id, lovedConf.PlaylistId, LOVED_PLAYLIST_NAME)
+	if err != nil {
+		log.Error("error finding loved playlist", "error", err)
+		return result, err
+	}
+	result.PlaylistId = playlistId
+	if playlistId != lovedConf.PlaylistId {
+		updateUser(user.Id, func(u *config.User) {
+			u.Sync.Loved.PlaylistId = playlistId
+		})
+	}
+
+	playlistTracks, err := spotifyApi.GetPlaylistTracks(user.Id, playlistId)
+	if err != nil {
+		log.Error("error fetching loved playlist tracks", "error", err)
+		return result, err
+	}
+
+	// Diff the loved tracks against what is already in the playlist
+	existing := make(map[string]bool)
+	for _, v := range playlistTracks.Items {
+		existing[v.Track.ID] = true
+	}
+	loved := make(map[string]bool)
+	var toAdd []string
+	for _, id := range trackIds {
+		if !existing[id] && !loved[id] {
+			toAdd = append(toAdd, id)
+		}
+		loved[id] = true
+	}
+	var toRemove []string
+	if lovedConf.RemoveUnloved {
+		// An empty loved list is more likely lastfm having a problem than the user unloving everything,
+		// and when the list is cut off at the max tracks, older loved tracks would look unloved
+		total, err := strconv.Atoi(lovedTracksData.Lovedtracks.Attr.Total)
+		cutOff := len(tracks) >= maxTracks && (err != nil || total > len(tracks))
+		switch {
+		case len(tracks) == 0:
+			log.Warn("Not removing unloved tracks as lastfm returned no loved tracks")
+		case cutOff:
+			log.Warn("Not removing unloved tracks as there are more loved tracks than the max tracks", "max", maxTracks)
+		default:
+			for id := range existing {
+				if !loved[id] {
+					toRemove = append(toRemove, id)
+				}
+			}
+		}
+	}
+	log.Info("loved playlist diff", "add", len(toAdd), "remove", len(toRemove))
+
+	if len(toAdd) > 0 {
+		_, err = spotifyApi.AddItemsToPlaylist(user.Id, playlistId, toAdd)
+		if err != nil {
+			log.Error("error adding items to playlist", "error", err)
+			return result, err
+		}
+	}
+	if len(toRemove) > 0 {
+		_, err = spotifyApi.RemoveItemsFromPlaylist(user.Id, playlistId, toRemove)
+		if err != nil {
+			log.Error("error removing items from playlist", "error", err)
+			return result, err
+		}
+	}
+
+	log.Info("Loved playlist synced!")
+	return result, nil
+}
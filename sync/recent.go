@@ -0,0 +1,52 @@
+package sync
+
+import (
+	"example/lastfm-spotify-syncer/config"
+	"example/lastfm-spotify-syncer/importer"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// How far back to look for plays the first time the recently played sync runs
+const DEFAULT_RECENT_LOOKBACK = 24 * time.Hour
+
+// Scrobble any of the user's recently played tracks on spotify that are missing from lastfm
+func syncRecentlyPlayed(user config.User) (*syncResult, error) {
+	since := user.Sync.Recent.LastPolledAt
+	if since.IsZero() {
+		since = time.Now().Add(-DEFAULT_RECENT_LOOKBACK)
+	}
+
+	plays, err := importer.GetRecentlyPlayed(user.Id, since)
+	if err != nil {
+		return nil, err
+	}
+	report, err := importer.Plan(user.LastFM.Username, plays)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("recently played plays", "total", report.Total, "missing", len(report.Pending), "already scrobbled", report.AlreadyScrobbled)
+	result := &syncResult{Tracks: report.Total}
+
+	if len(report.Pending) > 0 {
+		accepted, _, err := importer.Submit(user.LastFM.Token, report)
+		result.Matched = accepted
+		if err != nil {
+			return result, err
+		}
+	}
+
+	// Next time, only look at plays that finished after the newest one seen here
+	lastPlayed := since
+	for _, v := range plays {
+		if endedAt := v.StartedAt.Add(v.Duration); endedAt.After(lastPlayed) {
+			lastPlayed = endedAt
+		}
+	}
+	updateUser(user.Id, func(u *config.User) {
+		u.Sync.Recent.LastPolledAt = lastPlayed
+	})
+
+	return result, nil
+}
@@ -0,0 +1,271 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"example/lastfm-spotify-syncer/config"
+	lastFmApi "example/lastfm-spotify-syncer/lastfm/api"
+	spotifyApi "example/lastfm-spotify-syncer/spotify/api"
+	"os"
+	"strconv"
+	gosync "sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const REDISCOVERY_PLAYLIST_NAME = "Last.fm Forgotten Favourites"
+
+const DEFAULT_REDISCOVERY_MONTHS = 6
+const DEFAULT_MIN_PLAYCOUNT = 10
+const DEFAULT_REDISCOVERY_MAX_TRACKS = 50
+
+// How many of the user's all time top tracks to look through
+const HISTORY_PAGE_SIZE = 1000
+const MAX_HISTORY_PAGES = 5
+
+// The most tracks lastfm will return per page of recent tracks
+const RECENT_TRACKS_PAGE_SIZE = 200
+
+// How many pages of older plays to fetch in a single sync. The rest of the history is fetched on later syncs,
+// so the first few syncs for a heavy user don't make hundreds of requests
+const MAX_HISTORY_BACKFILL_PAGES = 25
+
+// Lastfm accepts scrobbles up to 14 days after the track was played, so plays this old may not have been seen yet
+const LATE_SCROBBLE_WINDOW = 14 * 24 * time.Hour
+
+// Sync a single playlist of the user's all time favourite tracks that they haven't played in a while.
+// The playlist is reused, and its contents are replaced on each sync
+func syncRediscovery(user config.User) (*syncResult, error) {
+	rediscoveryConf := user.Sync.Rediscovery
+	username := user.LastFM.Username
+
+	months := rediscoveryConf.Months
+	if months <= 0 {
+		months = DEFAULT_REDISCOVERY_MONTHS
+	}
+	minPlaycount := rediscoveryConf.MinPlaycount
+	if minPlaycount <= 0 {
+		minPlaycount = DEFAULT_MIN_PLAYCOUNT
+	}
+	maxTracks := rediscoveryConf.MaxTracks
+	if maxTracks <= 0 {
+		maxTracks = DEFAULT_REDISCOVERY_MAX_TRACKS
+	}
+
+	recentlyPlayed, complete, err := getRecentlyPlayed(user.Id, username, time.Now().AddDate(0, -months, 0))
+	if err != nil {
+		return nil, err
+	}
+	// Tracks played in the part of the history that hasn't been fetched yet would look forgotten,
+	// so the playlist is left as it is until the whole history has been fetched
+	if !complete {
+		log.Info("Play history is still being fetched, the rediscovery playlist will be updated once it is complete")
+		return &syncResult{PlaylistName: REDISCOVERY_PLAYLIST_NAME, PlaylistId: rediscoveryConf.PlaylistId}, nil
+	}
+	log.Info("recently played tracks", "count", len(recentlyPlayed))
+
+	// Top tracks are ordered by playcount, so stop looking once they drop below the minimum
+	var tracks []track
+	done := false
+	for page := 1; page <= MAX_HISTORY_PAGES && !done; page++ {
+		topTracksData, err := lastFmApi.GetTopTracksPage("overall", HISTORY_PAGE_SIZE, page, username)
+		if err != nil {
+			log.Error("Unable to fetch from last fm api", "error", err)
+			return nil, err
+		}
+
+		for _, v := range topTracksData.Toptracks.Track {
+			playcount, _ := strconv.Atoi(v.Playcount)
+			if playcount < minPlaycount || len(tracks) >= maxTracks {
+				done = true
+				break
+			}
+
+			t := track{Artist: v.Artist.Name, Name: v.Name}
+			if !recentlyPlayed[trackKey(t)] {
+				tracks = append(tracks, t)
+			}
+		}
+		if len(topTracksData.Toptracks.Track) < HISTORY_PAGE_SIZE {
+			break
+		}
+	}
+	log.Info("forgotten favourites", "count", len(tracks))
+
+	trackIds := matchTracks(user.Id, tracks)
+	log.Info("track ids", "ids", trackIds)
+	result := &syncResult{PlaylistName: REDISCOVERY_PLAYLIST_NAME, Tracks: len(tracks), Matched: len(trackIds)}
+
+	playlistId, err := getOrCreatePlaylist(user.Id, rediscoveryConf.PlaylistId, REDISCOVERY_PLAYLIST_NAME)
+	if err != nil {
+		log.Error("error finding rediscovery playlist", "error", err)
+		return result, err
+	}
+	result.PlaylistId = playlistId
+	if playlistId != rediscoveryConf.PlaylistId {
+		updateUser(user.Id, func(u *config.User) {
+			u.Sync.Rediscovery.PlaylistId = playlistId
+		})
+	}
+
+	_, err = spotifyApi.ReplacePlaylistItems(user.Id, playlistId, trackIds)
+	if err != nil {
+		log.Error("error replacing playlist items", "error", err)
+		return result, err
+	}
+
+	log.Info("Rediscovery playlist synced!")
+	return result, nil
+}
+
+// Guards the play history file, which is shared by every user's rediscovery syncs
+var playHistoryLock gosync.Mutex
+
+// The plays fetched for a user by the rediscovery sync, so each sync only needs to fetch what is new.
+// Every play between CoveredFrom and CoveredTo has been fetched
+type playHistory struct {
+	Username    string    `json:"username"`
+	CoveredFrom time.Time `json:"covered_from"`
+	CoveredTo   time.Time `json:"covered_to"`
+	// When each track was last played, keyed by trackKey
+	Plays map[string]time.Time `json:"plays"`
+}
+
+// Read every user's play history, keyed by user id. playHistoryLock must be held
+func readPlayHistories() map[string]*playHistory {
+	histories := make(map[string]*playHistory)
+
+	data, err := os.ReadFile(config.PlayHistoryFilename())
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Warn("Unable to read play history, starting with an empty one", "error", err)
+		}
+		return histories
+	}
+	err = json.Unmarshal(data, &histories)
+	if err != nil {
+		log.Warn("Unable to parse play history, starting with an empty one", "error", err)
+	}
+
+	return histories
+}
+
+func loadPlayHistory(userId string) *playHistory {
+	playHistoryLock.Lock()
+	defer playHistoryLock.Unlock()
+
+	history := readPlayHistories()[userId]
+	if history == nil || history.Plays == nil {
+		return &playHistory{Plays: make(map[string]time.Time)}
+	}
+
+	return history
+}
+
+func (h *playHistory) save(userId string) error {
+	playHistoryLock.Lock()
+	defer playHistoryLock.Unlock()
+
+	histories := readPlayHistories()
+	histories[userId] = h
+	data, err := json.Marshal(histories)
+	if err != nil {
+		log.Error("Error encoding play history", "error", err)
+		return err
+	}
+	err = config.WriteFileAtomic(config.PlayHistoryFilename(), data)
+	if err != nil {
+		log.Error("Error writing play history", "error", err)
+		return err
+	}
+
+	return nil
+}
+
+// Get the set of tracks the user has scrobbled since the given time, keyed by trackKey, and whether every play
+// since then has been fetched. Plays are cached between syncs, so only plays since the last sync are fetched,
+// along with a limited number of pages of older plays that haven't been fetched yet
+func getRecentlyPlayed(userId string, username string, since time.Time) (map[string]bool, bool, error) {
+	now := time.Now()
+	history := loadPlayHistory(userId)
+	if history.Username != username || history.CoveredTo.Before(since) {
+		history = &playHistory{Username: username, CoveredFrom: now, CoveredTo: now, Plays: make(map[string]time.Time)}
+	}
+
+	// Fetch everything since the last sync, going back far enough to catch plays scrobbled late
+	newFrom := history.CoveredTo.Add(-LATE_SCROBBLE_WINDOW)
+	if newFrom.Before(since) {
+		newFrom = since
+	}
+	_, err := history.fetchPlays(newFrom, now, 0, username)
+	if err != nil {
+		return nil, false, err
+	}
+	if newFrom.Before(history.CoveredFrom) {
+		history.CoveredFrom = newFrom
+	}
+	history.CoveredTo = now
+
+	// Then work back through older plays that haven't been fetched yet
+	if history.CoveredFrom.After(since) {
+		oldest, err := history.fetchPlays(since, history.CoveredFrom, MAX_HISTORY_BACKFILL_PAGES, username)
+		if err != nil {
+			return nil, false, err
+		}
+		history.CoveredFrom = oldest
+		if oldest.After(since) {
+			log.Info("Only part of the play history has been fetched, the rest will be fetched on the next syncs", "from", oldest)
+		}
+	}
+	complete := !history.CoveredFrom.After(since)
+
+	played := make(map[string]bool)
+	for key, playedAt := range history.Plays {
+		if playedAt.Before(since) {
+			delete(history.Plays, key)
+			continue
+		}
+		played[key] = true
+	}
+	history.save(userId)
+
+	return played, complete, nil
+}
+
+// Fetch the plays between from and to, newest first, into the history.
+// At most maxPages are fetched, or all of them if maxPages is 0. Returns how far back the plays were fetched,
+// which is from unless the page limit was reached
+func (h *playHistory) fetchPlays(from time.Time, to time.Time, maxPages int, username string) (time.Time, error) {
+	oldest := to
+	for page := 1; maxPages == 0 || page <= maxPages; page++ {
+		recentTracksData, err := lastFmApi.GetRecentTracksPage(from, to, RECENT_TRACKS_PAGE_SIZE, page, username)
+		if err != nil {
+			log.Error("Unable to fetch recent tracks from last fm api", "error", err)
+			return oldest, err
+		}
+
+		for _, v := range recentTracksData.Recenttracks.Track {
+			// The track playing now has no date, and will be scrobbled later
+			uts, err := strconv.ParseInt(v.Date.Uts, 10, 64)
+			if err != nil {
+				continue
+			}
+			playedAt := time.Unix(uts, 0)
+			key := trackKey(track{Artist: v.Artist.Text, Name: v.Name})
+			if playedAt.After(h.Plays[key]) {
+				h.Plays[key] = playedAt
+			}
+			if playedAt.Before(oldest) {
+				oldest = playedAt
+			}
+		}
+
+		totalPages, err := strconv.Atoi(recentTracksData.Recenttracks.Attr.TotalPages)
+		if err != nil || page >= totalPages || len(recentTracksData.Recenttracks.Track) == 0 {
+			return from, nil
+		}
+	}
+
+	return oldest, nil
+}
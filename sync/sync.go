@@ -3,15 +3,21 @@ package sync
 import (
 	"errors"
 	"example/lastfm-spotify-syncer/config"
+	"example/lastfm-spotify-syncer/cover"
 	lastFmApi "example/lastfm-spotify-syncer/lastfm/api"
+	"example/lastfm-spotify-syncer/metrics"
 	spotifyApi "example/lastfm-spotify-syncer/spotify/api"
 	"fmt"
+	"net/http"
 	"regexp"
 	"time"
 
 	"github.com/charmbracelet/log"
 )
 
+// Used when a weekly or monthly sync has no max tracks set, which is how many lastfm returns by default
+const DEFAULT_PERIOD_MAX_TRACKS = 50
+
 // transformStringForSpotify removes "'" "{" and "}" from a given string, as Spotify can't handle them in the track name when searching
 func transformStringForSpotify(str string) string {
 	// Define the pattern to match ', { and }
@@ -22,50 +28,48 @@ func transformStringForSpotify(str string) string {
 	return result
 }
 
-// Sync the lastfm track data into a spotify playlist
-func Sync(period string) error {
-	var topTracksData *lastFmApi.TopTracks
-	var err error
+// A lastfm track that should be matched against the spotify catalogue.
+// If the spotify id is already known, the search is skipped
+type track struct {
+	Artist    string
+	Name      string
+	SpotifyId string
+	// The url of the track's album art on lastfm, if known
+	Image string
+}
 
-	conf, err := config.LoadConfig(false)
-	if err != nil {
-		log.Error("Error loading config", "err", err)
-		return err
+// The url of the largest image in a lastfm image list
+func largestImage(images []struct {
+	Size string `json:"size"`
+	Text string `json:"#text"`
+}) string {
+	if len(images) == 0 {
+		return ""
 	}
 
-	switch period {
-	case "weekly":
-		topTracksData, err = lastFmApi.GetTopTracks(period, conf.Config.Sync.Weekly.MaxTracks, conf.Auth.LastFM.Username)
-	case "monthly":
-		topTracksData, err = lastFmApi.GetTopTracks(period, conf.Config.Sync.Monthly.MaxTracks, conf.Auth.LastFM.Username)
-	default:
-		log.Error("Invalid frequency given", "freq", period)
-		return errors.New("invalid period given")
-	}
-	if err != nil {
-		log.Error("Unable to fetch from last fm api", "error", err)
-		return err
-	}
-	spotifyUserData, err := spotifyApi.GetUser()
-	if err != nil {
-		log.Error("Unable to fetch from spotify api", "error", err)
-		return err
-	}
+	// Lastfm lists images from smallest to largest
+	return images[len(images)-1].Text
+}
 
+// Search spotify for each of the given tracks, returning the ids of those that could be found.
+// Tracks that can't be found are skipped
+func matchTracks(userId string, tracks []track) []string {
 	var trackIds []string
 
 	// Iterate and search for each track
 	// TODO: concurrently?
-	for _, v := range topTracksData.Toptracks.Track {
-		trackName := v.Name
-		artistName := v.Artist.Name
-		log.Info("track data", "name", trackName, "artist", artistName)
+	for _, v := range tracks {
+		log.Info("track data", "name", v.Name, "artist", v.Artist)
+		if v.SpotifyId != "" {
+			trackIds = append(trackIds, v.SpotifyId)
+			continue
+		}
 
 		var searchData spotifyApi.Search
-		searchQuery := fmt.Sprintf("artist: \"%s\" track: \"%s\"", artistName, trackName)
+		searchQuery := fmt.Sprintf("artist: \"%s\" track: \"%s\"", v.Artist, v.Name)
 		searchQuery = transformStringForSpotify(searchQuery)
 		log.Debug("search query string", "query", searchQuery)
-		err := spotifyApi.Get(&searchData, "/search", map[string]string{
+		err := spotifyApi.Get(userId, &searchData, "/search", map[string]string{
 			"q":     searchQuery,
 			"type":  "track",
 			"limit": "1",
@@ -83,39 +87,295 @@ func Sync(period string) error {
 		}
 		trackIds = append(trackIds, items[0].ID)
 	}
+
+	return trackIds
+}
+
+// Get the user's top tracks for the period from lastfm
+func getTopTracks(period string, limit int, username string) ([]track, error) {
+	topTracksData, err := lastFmApi.GetTopTracks(period, limit, username)
+	if err != nil {
+		log.Error("Unable to fetch from last fm api", "error", err)
+		return nil, err
+	}
+
+	var tracks []track
+	for _, v := range topTracksData.Toptracks.Track {
+		tracks = append(tracks, track{Artist: v.Artist.Name, Name: v.Name, Image: largestImage(v.Image)})
+	}
+
+	return tracks, nil
+}
+
+// What a sync produced, recorded in the user's history
+type syncResult struct {
+	PlaylistId   string
+	PlaylistName string
+	// How many tracks were found on lastfm, and how many of those were matched on spotify
+	Tracks  int
+	Matched int
+}
+
+// Sync the lastfm track data for a user into a spotify playlist.
+// The outcome of the sync is recorded in the user's history
+func Sync(userId string, period string) error {
+	conf, err := config.LoadConfig(false)
+	if err != nil {
+		log.Error("Error loading config", "err", err)
+		return err
+	}
+	userConf := conf.GetUser(userId)
+	if userConf == nil {
+		log.Error("Invalid user given", "user", userId)
+		return fmt.Errorf("no user with id %s", userId)
+	}
+	// Take a copy, as the config can change while the sync is running
+	user := *userConf
+
+	startedAt := time.Now()
+	var result *syncResult
+	switch period {
+	case "weekly":
+		result, err = syncPeriod(user, period, user.Sync.Weekly)
+	case "monthly":
+		result, err = syncPeriod(user, period, user.Sync.Monthly)
+	case "loved":
+		result, err = syncLoved(user)
+	case "discovery":
+		result, err = syncDiscovery(user)
+	case "rediscovery":
+		result, err = syncRediscovery(user)
+	case "liked":
+		result, err = syncLiked(user)
+	case "recent":
+		result, err = syncRecentlyPlayed(user)
+	default:
+		log.Error("Invalid frequency given", "freq", period)
+		return errors.New("invalid period given")
+	}
+
+	recordRun(userId, period, startedAt, result, err)
+
+	return err
+}
+
+// Record the outcome of a sync in the user's history
+func recordRun(userId string, period string, startedAt time.Time, result *syncResult, err error) {
+	run := config.SyncRun{Period: period, StartedAt: startedAt, FinishedAt: time.Now()}
+	if result != nil {
+		run.PlaylistId = result.PlaylistId
+		run.PlaylistName = result.PlaylistName
+		run.Tracks = result.Tracks
+		run.Matched = result.Matched
+	}
+	switch {
+	case err == nil:
+		run.Outcome = config.OUTCOME_SUCCESS
+	case IsReauthRequired(err):
+		run.Outcome = config.OUTCOME_REAUTH_REQUIRED
+		run.Error = err.Error()
+	default:
+		run.Outcome = config.OUTCOME_FAILED
+		run.Error = err.Error()
+	}
+	updateUser(userId, func(u *config.User) {
+		u.AddHistory(run)
+	})
+	metrics.ObserveSync(period, run.Outcome, run.FinishedAt.Sub(startedAt), run.Tracks, run.Matched)
+}
+
+// Sync the user's top tracks or artists for the week or month into a new spotify playlist
+func syncPeriod(user config.User, period string, periodConf config.Period) (*syncResult, error) {
+	if periodConf.MaxTracks <= 0 {
+		periodConf.MaxTracks = DEFAULT_PERIOD_MAX_TRACKS
+	}
+	var tracks []track
+	var err error
+	playlistPrefix := "LastFM Top Tracks"
+	switch periodConf.Source {
+	case config.SOURCE_TOP_ARTISTS:
+		tracks, err = getTopArtistTracks(user.Id, period, periodConf, user.LastFM.Username)
+		playlistPrefix = "LastFM Top Artists"
+		if err == nil && hasTagFilters(periodConf) {
+			cache := loadTagCache()
+			tracks = filterTracksByTags(cache, tracks, periodConf, len(tracks))
+			cache.save()
+		}
+	default:
+		if hasTagFilters(periodConf) {
+			tracks, err = getFilteredTopTracks(period, periodConf, user.LastFM.Username)
+		} else {
+			tracks, err = getTopTracks(period, periodConf.MaxTracks, user.LastFM.Username)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if periodConf.MaxTracks > 0 && len(tracks) > periodConf.MaxTracks {
+		tracks = tracks[:periodConf.MaxTracks]
+	}
+
+	spotifyUserData, err := spotifyApi.GetUser(user.Id)
+	if err != nil {
+		log.Error("Unable to fetch from spotify api", "error", err)
+		return nil, err
+	}
+
+	trackIds := matchTracks(user.Id, tracks)
 	log.Info("track ids", "ids", trackIds)
 
-	var playlistName string
+	var periodText string
 	switch period {
 	case "weekly":
 		now := time.Now()
 		sevenDaysAgo := now.AddDate(0, 0, -7)
 		year := sevenDaysAgo.Year()
-		playlistName = fmt.Sprintf("LastFM Top Tracks: %s-%s %d", sevenDaysAgo.Format("Jan 02"), now.Format("Jan 02"), year)
+		periodText = fmt.Sprintf("%s-%s %d", sevenDaysAgo.Format("Jan 02"), now.Format("Jan 02"), year)
 	case "monthly":
 		currentTime := time.Now()
 		firstDayOfCurrentMonth := time.Date(currentTime.Year(), currentTime.Month(), 1, 0, 0, 0, 0, currentTime.Location())
 		lastDayOfPreviousMonth := firstDayOfCurrentMonth.Add(-time.Second)
 		previousMonth := lastDayOfPreviousMonth.Month()
 		year := lastDayOfPreviousMonth.Year()
-		playlistName = fmt.Sprintf("LastFM Top Tracks: %s %d", previousMonth, year)
+		periodText = fmt.Sprintf("%s %d", previousMonth, year)
 	}
+	playlistName := fmt.Sprintf("%s: %s", playlistPrefix, periodText)
+	result := &syncResult{PlaylistName: playlistName, Tracks: len(tracks), Matched: len(trackIds)}
 
 	// Create a new playlist
-	playlistData, err := spotifyApi.CreatePlaylist(spotifyUserData.ID, playlistName)
+	playlistData, err := spotifyApi.CreatePlaylist(user.Id, spotifyUserData.ID, playlistName)
 	if err != nil {
 		log.Error("error creating playlist", "error", err)
-		return err
+		return result, err
 	}
 	log.Info("created playlist", "playlist", playlistData)
+	result.PlaylistId = playlistData.ID
 
 	// Add the tracks to the new playlist by uri
-	_, err = spotifyApi.AddItemsToPlaylist(playlistData.ID, trackIds)
+	_, err = spotifyApi.AddItemsToPlaylist(user.Id, playlistData.ID, trackIds)
 	if err != nil {
 		log.Error("error adding items to playlist playlist", "error", err)
-		return err // TODO: try delete the blank playlist here
+		return result, err // TODO: try delete the blank playlist here
+	}
+
+	if periodConf.CustomCover {
+		setPlaylistCover(user.Id, playlistData.ID, tracks, []string{playlistPrefix, periodText})
 	}
 
 	log.Info("Populated playlist!")
-	return nil
+	return result, nil
+}
+
+// Check whether a playlist that is reused between syncs still exists. An empty id never exists
+func playlistExists(userId string, playlistId string) (bool, error) {
+	if playlistId == "" {
+		return false, nil
+	}
+
+	var playlistData spotifyApi.CreatePlaylistReturnData
+	err := spotifyApi.Get(userId, &playlistData, "/playlists/"+playlistId, map[string]string{"fields": "id"})
+
+	var statusErr *spotifyApi.StatusError
+	if err == nil {
+		return true, nil
+	} else if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		return false, err
+	}
+	log.Warn("Playlist no longer exists", "id", playlistId)
+
+	return false, nil
+}
+
+// Generate a cover for a playlist from the tracks' album art, or a title card with the given lines, and upload it.
+// The cover is a nice to have, so failures are only logged rather than failing the sync
+func setPlaylistCover(userId string, playlistId string, tracks []track, lines []string) {
+	var imageUrls []string
+	for _, v := range tracks {
+		imageUrls = append(imageUrls, v.Image)
+	}
+
+	coverData, err := cover.Generate(imageUrls, lines)
+	if err != nil {
+		log.Warn("Unable to generate playlist cover", "error", err)
+		return
+	}
+	err = spotifyApi.UploadPlaylistCover(userId, playlistId, coverData)
+	if err != nil {
+		log.Warn("Unable to upload playlist cover. Authorise with spotify again if this is a permissions error", "error", err)
+		return
+	}
+
+	log.Info("Uploaded playlist cover", "playlist", playlistId)
+}
+
+// Apply a change to a user and save the config.
+// The user is looked up again rather than held on to, as users may have been added or removed in the meantime
+func updateUser(userId string, update func(u *config.User)) error {
+	err := config.Update(func(conf *config.Config) error {
+		user := conf.GetUser(userId)
+		if user == nil {
+			log.Warn("User no longer exists", "user", userId)
+			return fmt.Errorf("no user with id %s", userId)
+		}
+
+		update(user)
+		return nil
+	})
+	if err != nil {
+		log.Error("Error updating user", "user", userId, "err", err)
+	}
+
+	return err
+}
+
+// Get the id of a playlist that is reused between syncs, creating it for the user with the given name if it doesn't exist yet
+func getOrCreatePlaylist(userId string, playlistId string, name string) (string, error) {
+	exists, err := playlistExists(userId, playlistId)
+	if err != nil {
+		return "", err
+	} else if exists {
+		return playlistId, nil
+	}
+
+	spotifyUserData, err := spotifyApi.GetUser(userId)
+	if err != nil {
+		log.Error("Unable to fetch from spotify api", "error", err)
+		return "", err
+	}
+
+	playlistData, err := spotifyApi.CreatePlaylist(userId, spotifyUserData.ID, name)
+	if err != nil {
+		return "", err
+	}
+	log.Info("created playlist", "playlist", playlistData)
+
+	return playlistData.ID, nil
+}
+
+// Check whether an error means the user needs to re-authorize with lastfm or spotify
+func IsReauthRequired(err error) bool {
+	return errors.Is(err, spotifyApi.ErrReauthRequired) || lastFmApi.IsReauthRequired(err)
+}
+
+// Check whether a user's sync failed because they need to re-authorize with lastfm or spotify.
+// If so, the service is flagged on the user so it can be shown in the UI, and true is returned
+func FlagReauthRequired(userId string, err error) bool {
+	spotifyReauth := errors.Is(err, spotifyApi.ErrReauthRequired)
+	lastFmReauth := lastFmApi.IsReauthRequired(err)
+	if !spotifyReauth && !lastFmReauth {
+		return false
+	}
+
+	updateUser(userId, func(u *config.User) {
+		if spotifyReauth {
+			log.Warn("Spotify re-authorization required", "user", userId, "error", err)
+			u.Spotify.ReauthRequired = true
+		}
+		if lastFmReauth {
+			log.Warn("LastFM re-authorization required", "user", userId, "error", err)
+			u.LastFM.ReauthRequired = true
+		}
+	})
+
+	return true
 }
@@ -0,0 +1,228 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"example/lastfm-spotify-syncer/config"
+	lastFmApi "example/lastfm-spotify-syncer/lastfm/api"
+	"os"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// How long cached tags are used for before being fetched from lastfm again
+const TAG_CACHE_TTL = 30 * 24 * time.Hour
+
+// How many pages of top tracks to look through when trying to fill a filtered playlist
+const MAX_FILTER_PAGES = 10
+
+type tagWeight struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+}
+
+type cachedTags struct {
+	Tags      []tagWeight `json:"tags"`
+	FetchedAt time.Time   `json:"fetched_at"`
+}
+
+// Guards the tag cache file, which is shared by every user's syncs
+var tagCacheLock gosync.Mutex
+
+// Caches the lastfm tags for tracks and artists, so they don't need to be fetched for every sync
+type tagCache struct {
+	Tracks  map[string]cachedTags `json:"tracks"`
+	Artists map[string]cachedTags `json:"artists"`
+}
+
+func loadTagCache() *tagCache {
+	tagCacheLock.Lock()
+	defer tagCacheLock.Unlock()
+
+	return readTagCache()
+}
+
+func readTagCache() *tagCache {
+	cache := tagCache{
+		Tracks:  make(map[string]cachedTags),
+		Artists: make(map[string]cachedTags),
+	}
+
+	data, err := os.ReadFile(config.TagCacheFilename())
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Warn("Unable to read tag cache, starting with an empty one", "error", err)
+		}
+		return &cache
+	}
+	err = json.Unmarshal(data, &cache)
+	if err != nil {
+		log.Warn("Unable to parse tag cache, starting with an empty one", "error", err)
+	}
+	if cache.Tracks == nil {
+		cache.Tracks = make(map[string]cachedTags)
+	}
+	if cache.Artists == nil {
+		cache.Artists = make(map[string]cachedTags)
+	}
+
+	return &cache
+}
+
+// Save the cache, keeping any tags other syncs have fetched since it was loaded
+func (c *tagCache) save() error {
+	tagCacheLock.Lock()
+	defer tagCacheLock.Unlock()
+
+	current := readTagCache()
+	mergeTags(current.Tracks, c.Tracks)
+	mergeTags(current.Artists, c.Artists)
+	data, err := json.Marshal(current)
+	if err != nil {
+		log.Error("Error encoding tag cache", "error", err)
+		return err
+	}
+	err = config.WriteFileAtomic(config.TagCacheFilename(), data)
+	if err != nil {
+		log.Error("Error writing tag cache", "error", err)
+		return err
+	}
+
+	return nil
+}
+
+// Copy tags into dst, unless dst has more recently fetched tags for the same key
+func mergeTags(dst map[string]cachedTags, src map[string]cachedTags) {
+	for key, tags := range src {
+		if existing, ok := dst[key]; !ok || tags.FetchedAt.After(existing.FetchedAt) {
+			dst[key] = tags
+		}
+	}
+}
+
+// Get the tags for a track, falling back to the artist's tags if the track hasn't been tagged
+func (c *tagCache) getTags(t track) ([]tagWeight, error) {
+	key := trackKey(t)
+	cached, ok := c.Tracks[key]
+	if !ok || time.Since(cached.FetchedAt) > TAG_CACHE_TTL {
+		topTagsData, err := lastFmApi.GetTrackTopTags(t.Artist, t.Name)
+		if err != nil {
+			return nil, err
+		}
+		cached = cachedTags{Tags: toTagWeights(topTagsData.Toptags), FetchedAt: time.Now()}
+		c.Tracks[key] = cached
+	}
+	if len(cached.Tags) > 0 {
+		return cached.Tags, nil
+	}
+
+	artistKey := strings.ToLower(t.Artist)
+	cached, ok = c.Artists[artistKey]
+	if !ok || time.Since(cached.FetchedAt) > TAG_CACHE_TTL {
+		topTagsData, err := lastFmApi.GetArtistTopTags(t.Artist)
+		if err != nil {
+			return nil, err
+		}
+		cached = cachedTags{Tags: toTagWeights(topTagsData.Toptags), FetchedAt: time.Now()}
+		c.Artists[artistKey] = cached
+	}
+
+	return cached.Tags, nil
+}
+
+func toTagWeights(tags lastFmApi.Tags) []tagWeight {
+	var weights []tagWeight
+	for _, v := range tags.Tag {
+		weights = append(weights, tagWeight{Name: strings.ToLower(v.Name), Weight: v.Count})
+	}
+
+	return weights
+}
+
+// Whether any tag filters are set for the period
+func hasTagFilters(periodConf config.Period) bool {
+	return len(periodConf.IncludeTags) > 0 || len(periodConf.ExcludeTags) > 0
+}
+
+// Check a track's tags against the period's include and exclude filters
+func matchesTagFilters(tags []tagWeight, periodConf config.Period) bool {
+	tagSet := make(map[string]bool)
+	for _, v := range tags {
+		if v.Weight >= periodConf.MinTagWeight {
+			tagSet[v.Name] = true
+		}
+	}
+
+	for _, v := range periodConf.ExcludeTags {
+		if tagSet[strings.ToLower(v)] {
+			return false
+		}
+	}
+	if len(periodConf.IncludeTags) == 0 {
+		return true
+	}
+	for _, v := range periodConf.IncludeTags {
+		if tagSet[strings.ToLower(v)] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Remove any tracks that don't match the period's tag filters, keeping at most limit tracks
+func filterTracksByTags(cache *tagCache, tracks []track, periodConf config.Period, limit int) []track {
+	var filtered []track
+	for _, v := range tracks {
+		if len(filtered) >= limit {
+			break
+		}
+
+		tags, err := cache.getTags(v)
+		if err != nil {
+			log.Error("error fetching tags", "error", err)
+			continue
+		}
+		if matchesTagFilters(tags, periodConf) {
+			filtered = append(filtered, v)
+		} else {
+			log.Debug("track filtered out by tags", "name", v.Name, "artist", v.Artist)
+		}
+	}
+
+	return filtered
+}
+
+// Get the user's top tracks for the period that match the period's tag filters.
+// As tracks will be filtered out, this pages further down the user's top tracks until the playlist is filled
+func getFilteredTopTracks(period string, periodConf config.Period, username string) ([]track, error) {
+	cache := loadTagCache()
+	defer cache.save()
+
+	pageSize := max(periodConf.MaxTracks, 50)
+
+	var tracks []track
+	for page := 1; page <= MAX_FILTER_PAGES && len(tracks) < periodConf.MaxTracks; page++ {
+		topTracksData, err := lastFmApi.GetTopTracksPage(period, pageSize, page, username)
+		if err != nil {
+			log.Error("Unable to fetch from last fm api", "error", err)
+			return nil, err
+		}
+
+		var pageTracks []track
+		for _, v := range topTracksData.Toptracks.Track {
+			pageTracks = append(pageTracks, track{Artist: v.Artist.Name, Name: v.Name, Image: largestImage(v.Image)})
+		}
+		tracks = append(tracks, filterTracksByTags(cache, pageTracks, periodConf, periodConf.MaxTracks-len(tracks))...)
+
+		if len(pageTracks) < pageSize {
+			break
+		}
+	}
+	log.Info("tag filtered tracks", "count", len(tracks))
+
+	return tracks, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"example/lastfm-spotify-syncer/config"
+	"example/lastfm-spotify-syncer/scheduler"
+	"net/http"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/gin-gonic/gin"
+)
+
+// The cookie holding the id of the user the web UI is currently showing
+const CURRENT_USER_COOKIE = "syncer_user"
+
+var errLastUser = errors.New("the last user cannot be removed")
+
+// Get the user the web UI is currently showing.
+// A ?user= query param switches user, otherwise the user is taken from the cookie, falling back to the first user
+func getCurrentUser(c *gin.Context, conf *config.Config) *config.User {
+	if userId := c.Query("user"); userId != "" {
+		if user := conf.GetUser(userId); user != nil {
+			setCurrentUser(c, user.Id)
+			return user
+		}
+		log.Warn("Unknown user selected", "user", userId)
+	}
+
+	userId, err := c.Cookie(CURRENT_USER_COOKIE)
+	if err == nil {
+		if user := conf.GetUser(userId); user != nil {
+			return user
+		}
+	}
+
+	return &conf.Users[0]
+}
+
+// Remember which user the web UI is showing
+func setCurrentUser(c *gin.Context, userId string) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(CURRENT_USER_COOKIE, userId, 60*60*24*365, "/", "", secureCookies(), true)
+}
+
+// Add a new user and switch to them
+func addUser(c *gin.Context) {
+	type AddUserParams struct {
+		Name string `form:"name"`
+	}
+	var params AddUserParams
+	err := c.ShouldBind(&params)
+	name := strings.TrimSpace(params.Name)
+	if err != nil || name == "" {
+		c.String(http.StatusBadRequest, "A name is required")
+		return
+	}
+
+	var user config.User
+	err = config.Update(func(conf *config.Config) error {
+		user = *conf.AddUser(name)
+		return nil
+	})
+	if err != nil {
+		respondUpdateError(c, err, "")
+		return
+	}
+	log.Info("Added user", "id", user.Id, "name", user.Name)
+
+	setCurrentUser(c, user.Id)
+	c.Redirect(http.StatusFound, "/")
+}
+
+// Remove a user along with their scheduled jobs and the blends they own
+func deleteUser(c *gin.Context) {
+	err := removeUser(c.Param("user"))
+	if errors.Is(err, errLastUser) {
+		c.String(http.StatusBadRequest, "The last user cannot be removed")
+		return
+	}
+	if err != nil {
+		respondUpdateError(c, err, "No such user")
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/")
+}
+
+// Remove a user along with their scheduled jobs and the blends they own.
+// Returns errLastUser if they are the only user, as there must always be one
+func removeUser(userId string) error {
+	var removedBlends []string
+	err := config.Update(func(conf *config.Config) error {
+		if len(conf.Users) <= 1 {
+			return errLastUser
+		}
+		if !conf.RemoveUser(userId) {
+			return errNotFound
+		}
+		// Their blends can't sync without their spotify account
+		for _, blend := range append([]config.Blend{}, conf.Blends...) {
+			if blend.OwnerId == userId {
+				conf.RemoveBlend(blend.Id)
+				removedBlends = append(removedBlends, blend.Id)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	scheduler.StopUserJobs(userId)
+	for _, blendId := range removedBlends {
+		scheduler.StopBlendJob(blendId)
+	}
+	log.Info("Removed user", "id", userId)
+
+	return nil
+}